@@ -0,0 +1,85 @@
+// command line client basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchResult 多次调用的统计
+type benchResult struct {
+	total     int
+	errors    int
+	firstErr  error
+	elapsed   time.Duration
+	latencies []time.Duration
+}
+
+// bench 使用 c 个goroutine调用 n 次 call
+func bench(n int, c int, call func() error) *benchResult {
+	ret := &benchResult{total: n, latencies: make([]time.Duration, n)}
+	var next atomic.Int64
+	var errOnce sync.Once
+	var errCount atomic.Int64
+	wg := sync.WaitGroup{}
+	start := time.Now()
+	for i := 0; i < c; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				idx := int(next.Add(1)) - 1
+				if idx >= n {
+					return
+				}
+				begin := time.Now()
+				err := call()
+				ret.latencies[idx] = time.Since(begin)
+				if err != nil {
+					errCount.Add(1)
+					errOnce.Do(func() {
+						ret.firstErr = err
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	ret.elapsed = time.Since(start)
+	ret.errors = int(errCount.Load())
+	sort.Slice(ret.latencies, func(i, j int) bool {
+		return ret.latencies[i] < ret.latencies[j]
+	})
+	return ret
+}
+
+// percentile p 取值 (0,100]
+func (r *benchResult) percentile(p float64) time.Duration {
+	idx := int(float64(len(r.latencies))*p/100+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(r.latencies) {
+		idx = len(r.latencies) - 1
+	}
+	return r.latencies[idx]
+}
+
+func (r *benchResult) print(w io.Writer) {
+	var sum time.Duration
+	for _, l := range r.latencies {
+		sum += l
+	}
+	fmt.Fprintf(w, "requests: %d, errors: %d, elapsed: %v, qps: %.1f\n", r.total, r.errors, r.elapsed, float64(r.total)/r.elapsed.Seconds())
+	fmt.Fprintf(w, "latency: min %v, avg %v, p50 %v, p90 %v, p99 %v, max %v\n",
+		r.latencies[0], sum/time.Duration(len(r.latencies)), r.percentile(50), r.percentile(90), r.percentile(99), r.latencies[len(r.latencies)-1])
+	if r.firstErr != nil {
+		fmt.Fprintln(w, "first error:", r.firstErr)
+	}
+}
@@ -0,0 +1,198 @@
+// command line client basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+// nfourctl 调用nfour json rpc服务的命令行工具，用于调试和简单的压测:
+//
+//	nfourctl [flags] <key> [body]
+//
+// body 是请求对象的json，没有 body 或者 body 为 - 时从标准输入读取。调用一次时响应的 Body 输出到标准输出，
+// 业务错误和框架错误输出到标准错误，退出码为1；调用多次时输出耗时统计。
+//
+// 只有 JsonProtoRes.Error 携带的业务错误才会被识别，自定义的 HandleErrorFunc 把错误编码到 Body 时(比如 {"code":500,...})，
+// 缺省情况下被当作正常响应，退出码为0。这时可以使用 -expect 指定成功响应的字段值，比如 -expect code=200，
+// Body 不是json对象或者字段值不相等时当作错误。
+//
+// 参数:
+//
+//	-addr    服务地址，缺省为 localhost:11011
+//	-codec   信封编解码，json、gob、msgpack、binary，缺省为json
+//	-timeout 单次请求的超时时间，缺省为3s
+//	-n       调用次数，缺省为1
+//	-c       并发数，缺省为1
+//	-time    调用一次时在标准错误输出耗时
+//	-expect  field=value，Body 的字段 field 等于 value 时才认为调用成功，value 按json解析，不是json时按字符串比较
+//
+// 示例:
+//
+//	echo '{"msg":"hi"}' | nfourctl -addr 127.0.0.1:11011 rpc.Test
+//	nfourctl -n 10000 -c 50 rpc.Test '{"msg":"hi"}'
+//	nfourctl -expect code=200 rpc.Test '{"msg":"hi"}'
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"github.com/rolandhe/saber/nfour/rpc/proto"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var codecs = map[string]proto.Codec{
+	"json":    proto.JsonCodec,
+	"gob":     proto.GobCodec,
+	"msgpack": proto.MsgpackCodec,
+	"binary":  proto.BinaryCodec,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run 执行命令，返回退出码
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("nfourctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	addr := flags.String("addr", "localhost:11011", "server address")
+	codecName := flags.String("codec", "json", "envelope codec: json, gob, msgpack or binary")
+	timeout := flags.Duration("timeout", time.Second*3, "timeout of each request")
+	n := flags.Int("n", 1, "number of requests")
+	c := flags.Int("c", 1, "number of concurrent requests")
+	timing := flags.Bool("time", false, "print elapsed time of a single request to stderr")
+	expect := flags.String("expect", "", "field=value, treat the response as an error unless the body field equals value")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: nfourctl [flags] <key> [body]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	codec, ok := codecs[*codecName]
+	if flags.NArg() < 1 || flags.NArg() > 2 || !ok || *n < 1 || *c < 1 {
+		flags.Usage()
+		return 2
+	}
+	var check *bodyCheck
+	if *expect != "" {
+		if check = parseExpect(*expect); check == nil {
+			fmt.Fprintf(stderr, "nfourctl: invalid -expect %q, need field=value\n", *expect)
+			flags.Usage()
+			return 2
+		}
+	}
+
+	key := flags.Arg(0)
+	body, err := readBody(flags.Arg(1), stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, "nfourctl:", err)
+		return 1
+	}
+
+	trans, err := duplex.NewTrans(*addr, duplex.NewTransConf(*timeout, uint(*c)), "nfourctl")
+	if err != nil {
+		fmt.Fprintln(stderr, "nfourctl:", err)
+		return 1
+	}
+	client := proto.NewRpcClient(codec, trans)
+	defer client.Shutdown("nfourctl")
+
+	send := func() (*proto.JsonProtoRes, error) {
+		res, err := client.SendRequest(&proto.JsonProtoReq{Key: key, Body: body}, &duplex.ReqTimeout{
+			ReadTimeout:    *timeout,
+			WriteTimeout:   *timeout,
+			WaitConcurrent: *timeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = res.Err(); err != nil {
+			return nil, err
+		}
+		if check != nil {
+			return res, check.check(res.Body)
+		}
+		return res, nil
+	}
+
+	if *n == 1 {
+		start := time.Now()
+		res, err := send()
+		if *timing {
+			fmt.Fprintln(stderr, "time:", time.Since(start))
+		}
+		// -expect 检查失败时仍然输出 Body，便于查看错误信息
+		if res != nil {
+			stdout.Write(res.Body)
+			fmt.Fprintln(stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "nfourctl:", err)
+			return 1
+		}
+		return 0
+	}
+
+	ret := bench(*n, *c, func() error {
+		_, err := send()
+		return err
+	})
+	ret.print(stdout)
+	if ret.errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readBody 读取请求对象，arg 为空或者为 - 时从 stdin 读取
+func readBody(arg string, stdin io.Reader) ([]byte, error) {
+	if arg != "" && arg != "-" {
+		return []byte(arg), nil
+	}
+	body, err := io.ReadAll(stdin)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, errors.New("empty request body")
+	}
+	return body, nil
+}
+
+// bodyCheck -expect 参数，Body 是json对象并且字段 field 的值等于 value 时认为调用成功
+type bodyCheck struct {
+	field string
+	value any
+}
+
+// parseExpect 解析 field=value，value 不是合法的json时按字符串处理，格式错误时返回nil
+func parseExpect(s string) *bodyCheck {
+	field, value, ok := strings.Cut(s, "=")
+	if !ok || field == "" {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		v = value
+	}
+	return &bodyCheck{field: field, value: v}
+}
+
+func (bc *bodyCheck) check(body []byte) error {
+	var obj map[string]any
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return errors.New("response body is not a json object")
+	}
+	v, ok := obj[bc.field]
+	if !ok {
+		return fmt.Errorf("response body has no field %q", bc.field)
+	}
+	if !reflect.DeepEqual(v, bc.value) {
+		return fmt.Errorf("response %s is %v, expect %v", bc.field, v, bc.value)
+	}
+	return nil
+}
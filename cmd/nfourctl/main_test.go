@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"github.com/rolandhe/saber/nfour/rpc/proto"
+	"net"
+	"strings"
+	"testing"
+)
+
+type echoReq struct {
+	Msg  string `json:"msg"`
+	Code int    `json:"code,omitempty"`
+}
+
+func startServer(t *testing.T) string {
+	working, errHandle, router := proto.NewNegotiatedRpcSrvWorking(nil, proto.JsonCodec, proto.BinaryCodec)
+	router.Register("echo", proto.FactorySameTypeHandleBiz(func(req *echoReq) (*echoReq, error) {
+		if req.Msg == "" {
+			return nil, errors.New("empty message")
+		}
+		return req, nil
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	go duplex.Serve(ln, nfour.NewSrvConf(working, errHandle, 100))
+	return ln.Addr().String()
+}
+
+func TestRun(t *testing.T) {
+	addr := startServer(t)
+	cases := []struct {
+		args   []string
+		stdin  string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{[]string{"-addr", addr, "echo", `{"msg":"hi"}`}, "", 0, `{"msg":"hi"}`, ""},
+		{[]string{"-addr", addr, "-codec", "binary", "-time", "echo"}, `{"msg":"stdin"}`, 0, `{"msg":"stdin"}`, "time:"},
+		{[]string{"-addr", addr, "echo", `{}`}, "", 1, "", "empty message"},
+		{[]string{"-addr", addr, "missing", `{}`}, "", 1, "", "unknown rpc key"},
+		{[]string{"-addr", addr, "-n", "20", "-c", "4", "echo", `{"msg":"hi"}`}, "", 0, "requests: 20, errors: 0", ""},
+		{[]string{"-codec", "xml", "echo"}, "", 2, "", "usage"},
+		{[]string{"-addr", addr, "echo", `{"msg":"hi","code":500}`}, "", 0, `"code":500`, ""},
+		{[]string{"-addr", addr, "-expect", "code=200", "echo", `{"msg":"hi","code":200}`}, "", 0, `"code":200`, ""},
+		{[]string{"-addr", addr, "-expect", "code=200", "echo", `{"msg":"hi","code":500}`}, "", 1, `"code":500`, "response code is 500, expect 200"},
+		{[]string{"-addr", addr, "-expect", "msg=hi", "echo", `{"msg":"hi"}`}, "", 0, `{"msg":"hi"}`, ""},
+		{[]string{"-addr", addr, "-expect", "code=200", "-n", "5", "echo", `{"msg":"hi","code":500}`}, "", 1, "errors: 5", ""},
+		{[]string{"-expect", "code", "echo"}, "", 2, "", "invalid -expect"},
+	}
+	for _, c := range cases {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := run(c.args, strings.NewReader(c.stdin), stdout, stderr)
+		if code != c.code || !strings.Contains(stdout.String(), c.stdout) || !strings.Contains(stderr.String(), c.stderr) {
+			t.Fatalf("%v: unexpected result %d, stdout %q, stderr %q", c.args, code, stdout, stderr)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// rpc stub generator basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
+	"text/template"
+)
+
+// method 接口中的一个rpc方法
+type method struct {
+	Name    string
+	Key     string
+	WithCtx bool
+	// Req 请求类型，不包含指针
+	Req string
+	// Res 响应类型，不包含指针
+	Res string
+}
+
+type service struct {
+	Package string
+	Type    string
+	Imports []string
+	Methods []*method
+	// HasCtx 是否有方法使用 context.Context，为true时导入 context 包
+	HasCtx bool
+}
+
+// generate 解析源文件中名称为 typeName 的接口，生成注册函数和客户端代码
+func generate(src []byte, filename string, typeName string, prefix string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	iface := findInterface(file, typeName)
+	if iface == nil {
+		return nil, fmt.Errorf("interface %s not found in %s", typeName, filename)
+	}
+
+	svc := &service{
+		Package: file.Name.Name,
+		Type:    typeName,
+	}
+	used := map[string]struct{}{}
+	for _, field := range iface.Methods.List {
+		ft, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) == 0 {
+			return nil, fmt.Errorf("%s: embedded interface is not supported", typeName)
+		}
+		m, err := parseMethod(fset, field.Names[0].Name, ft, used)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", typeName, field.Names[0].Name, err)
+		}
+		m.Key = prefix + "." + m.Name
+		svc.HasCtx = svc.HasCtx || m.WithCtx
+		svc.Methods = append(svc.Methods, m)
+	}
+	if len(svc.Methods) == 0 {
+		return nil, fmt.Errorf("interface %s has no method", typeName)
+	}
+	svc.Imports, err = resolveImports(file, used)
+	if err != nil {
+		return nil, err
+	}
+	// 请求或者响应类型使用了标准库 context 包中的类型，由模板导入
+	if _, ok := used["context"]; ok {
+		svc.HasCtx = true
+	}
+
+	buf := &bytes.Buffer{}
+	if err = codeTemplate.Execute(buf, svc); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+func findInterface(file *ast.File, typeName string) *ast.InterfaceType {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if ts.Name.Name != typeName {
+				continue
+			}
+			if iface, ok := ts.Type.(*ast.InterfaceType); ok {
+				return iface
+			}
+		}
+	}
+	return nil
+}
+
+// parseMethod 校验方法形式为 func([ctx context.Context,] req *T) (*V, error)，并记录方法签名中使用的包名
+func parseMethod(fset *token.FileSet, name string, ft *ast.FuncType, used map[string]struct{}) (*method, error) {
+	params := expandFields(ft.Params)
+	results := expandFields(ft.Results)
+	if len(results) != 2 || !isIdent(results[1], "error") {
+		return nil, fmt.Errorf("must return (*V, error)")
+	}
+	res, ok := results[0].(*ast.StarExpr)
+	if !ok {
+		return nil, fmt.Errorf("must return (*V, error)")
+	}
+	m := &method{Name: name}
+	switch len(params) {
+	case 1:
+	case 2:
+		sel, ok := params[0].(*ast.SelectorExpr)
+		if !ok || !isIdent(sel.X, "context") || sel.Sel.Name != "Context" {
+			return nil, fmt.Errorf("first parameter must be context.Context")
+		}
+		m.WithCtx = true
+	default:
+		return nil, fmt.Errorf("must accept ([ctx context.Context,] req *T)")
+	}
+	req, ok := params[len(params)-1].(*ast.StarExpr)
+	if !ok {
+		return nil, fmt.Errorf("request must be a pointer")
+	}
+	var err error
+	if m.Req, err = exprString(fset, req.X, used); err != nil {
+		return nil, err
+	}
+	if m.Res, err = exprString(fset, res.X, used); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// expandFields 把 (a, b *T) 形式的参数展开成每个参数一个类型
+func expandFields(fl *ast.FieldList) []ast.Expr {
+	if fl == nil {
+		return nil
+	}
+	var ret []ast.Expr
+	for _, f := range fl.List {
+		n := len(f.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			ret = append(ret, f.Type)
+		}
+	}
+	return ret
+}
+
+func isIdent(expr ast.Expr, name string) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && ident.Name == name
+}
+
+func exprString(fset *token.FileSet, expr ast.Expr, used map[string]struct{}) (string, error) {
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok {
+				used[ident.Name] = struct{}{}
+			}
+		}
+		return true
+	})
+	buf := &bytes.Buffer{}
+	if err := printer.Fprint(buf, fset, expr); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// reservedImports 生成代码导入的包名，nfour的包使用别名导入，避免与请求和响应类型所在的包(比如protobuf生成的proto包)同名
+var reservedImports = map[string]string{
+	"context":     "context",
+	"nfourduplex": "github.com/rolandhe/saber/nfour/duplex",
+	"nfourrpc":    "github.com/rolandhe/saber/nfour/rpc",
+	"nfourproto":  "github.com/rolandhe/saber/nfour/rpc/proto",
+}
+
+// resolveImports 根据方法签名中使用的包名从源文件的import中找到对应的导入声明，与生成代码导入的包同名但路径不同时返回错误
+func resolveImports(file *ast.File, used map[string]struct{}) ([]string, error) {
+	var ret []string
+	for name := range used {
+		spec := findImport(file, name)
+		if spec == nil {
+			return nil, fmt.Errorf("can't find import of package %s", name)
+		}
+		if reserved, ok := reservedImports[name]; ok {
+			if p, _ := strconv.Unquote(spec.Path.Value); p != reserved {
+				return nil, fmt.Errorf("package name %s of %s conflicts with generated imports, import it with another name", name, spec.Path.Value)
+			}
+			continue
+		}
+		decl := spec.Path.Value
+		if spec.Name != nil {
+			decl = spec.Name.Name + " " + decl
+		}
+		ret = append(ret, decl)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func findImport(file *ast.File, name string) *ast.ImportSpec {
+	for _, spec := range file.Imports {
+		if spec.Name != nil {
+			if spec.Name.Name == name {
+				return spec
+			}
+			continue
+		}
+		p, err := strconv.Unquote(spec.Path.Value)
+		if err == nil && path.Base(p) == name {
+			return spec
+		}
+	}
+	return nil
+}
+
+var codeTemplate = template.Must(template.New("rpc").Parse(`// Code generated by rpcgen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- if .HasCtx}}
+	"context"
+{{- end}}
+	nfourduplex "github.com/rolandhe/saber/nfour/duplex"
+	nfourrpc "github.com/rolandhe/saber/nfour/rpc"
+	nfourproto "github.com/rolandhe/saber/nfour/rpc/proto"
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+
+// Register{{.Type}} 把 {{.Type}} 的方法注册到 router，opts 应用于所有的方法，使用 context.Context 的方法通过 ctx 获取 nfourrpc.WithTimeout 设置的截止时间
+func Register{{.Type}}(router *nfourrpc.SrvRouter[nfourproto.JsonProtoReq, nfourproto.JsonProtoRes], impl {{.Type}}, opts ...nfourrpc.RouteOption) {
+{{- range .Methods}}
+{{- if .WithCtx}}
+	router.RegisterContext("{{.Key}}", nfourproto.FactoryHandleBizContext[{{.Req}}, {{.Res}}](impl.{{.Name}}), opts...)
+{{- else}}
+	router.Register("{{.Key}}", nfourproto.FactoryHandleBiz[{{.Req}}, {{.Res}}](impl.{{.Name}}), opts...)
+{{- end}}
+{{- end}}
+}
+
+// {{.Type}}Client 基于 nfourproto.JsonClient 的 {{.Type}} 客户端
+type {{.Type}}Client struct {
+	client nfourproto.JsonClient
+	// ReqTimeout 缺省的请求超时设置，nil表示使用底层 Transport 的配置，使用 context.Context 的方法中 ctx 的截止时间是 ReadTimeout 的上限，见 nfourproto.CallContext
+	ReqTimeout *nfourduplex.ReqTimeout
+}
+
+var _ {{.Type}} = (*{{.Type}}Client)(nil)
+
+// New{{.Type}}Client 构建 {{.Type}} 客户端
+func New{{.Type}}Client(client nfourproto.JsonClient) *{{.Type}}Client {
+	return &{{.Type}}Client{client: client}
+}
+
+// reqTimeout 每次请求使用 ReqTimeout 的拷贝，底层 Transport 会修改 ReqTimeout
+func (c *{{.Type}}Client) reqTimeout() *nfourduplex.ReqTimeout {
+	if c.ReqTimeout == nil {
+		return nil
+	}
+	rt := *c.ReqTimeout
+	return &rt
+}
+{{range .Methods}}
+// {{.Name}} 调用 {{.Key}}
+{{- if .WithCtx}}
+func (c *{{$.Type}}Client) {{.Name}}(ctx context.Context, req *{{.Req}}) (*{{.Res}}, error) {
+	return nfourproto.CallContext[{{.Req}}, {{.Res}}](ctx, c.client, "{{.Key}}", req, c.reqTimeout())
+}
+{{- else}}
+func (c *{{$.Type}}Client) {{.Name}}(req *{{.Req}}) (*{{.Res}}, error) {
+	return nfourproto.Call[{{.Req}}, {{.Res}}](c.client, "{{.Key}}", req, c.reqTimeout())
+}
+{{- end}}
+{{end}}`))
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSource = `package user
+
+import (
+	"context"
+	m "example.com/model"
+)
+
+type UserService interface {
+	Get(ctx context.Context, req *m.GetReq) (*m.User, error)
+	Rename(req *RenameReq) (*m.User, error)
+}
+
+type RenameReq struct {
+	Name string
+}
+`
+
+func TestGenerate(t *testing.T) {
+	code, err := generate([]byte(testSource), "user.go", "UserService", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(code)
+	for _, expect := range []string{
+		`m "example.com/model"`,
+		`router.RegisterContext("user.Get", nfourproto.FactoryHandleBizContext[m.GetReq, m.User](impl.Get), opts...)`,
+		`nfourproto.FactoryHandleBiz[RenameReq, m.User](impl.Rename), opts...)`,
+		`func (c *UserServiceClient) Get(ctx context.Context, req *m.GetReq) (*m.User, error)`,
+		`nfourproto.CallContext[m.GetReq, m.User](ctx, c.client, "user.Get", req, c.reqTimeout())`,
+		`nfourproto.Call[RenameReq, m.User](c.client, "user.Rename", req, c.reqTimeout())`,
+	} {
+		if !strings.Contains(s, expect) {
+			t.Fatalf("generated code does not contain %s:\n%s", expect, s)
+		}
+	}
+}
+
+func TestGenerateRejectsInvalidMethod(t *testing.T) {
+	src := `package user
+
+type Bad interface {
+	Get(id int) (string, error)
+}
+`
+	if _, err := generate([]byte(src), "bad.go", "Bad", "bad"); err == nil {
+		t.Fatal("expect error for invalid method")
+	}
+	if _, err := generate([]byte(src), "bad.go", "Missing", "bad"); err == nil {
+		t.Fatal("expect error for missing interface")
+	}
+}
+
+func TestGenerateImportCollision(t *testing.T) {
+	src := `package user
+
+import (
+	"context"
+
+	"example.com/gen/proto"
+	rpc "example.com/gen/rpcpb"
+)
+
+type UserService interface {
+	Get(ctx context.Context, req *proto.GetReq) (*rpc.User, error)
+}
+`
+	code, err := generate([]byte(src), "user.go", "UserService", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(code)
+	for _, expect := range []string{
+		`"example.com/gen/proto"`,
+		`rpc "example.com/gen/rpcpb"`,
+		`nfourproto "github.com/rolandhe/saber/nfour/rpc/proto"`,
+		`router *nfourrpc.SrvRouter[nfourproto.JsonProtoReq, nfourproto.JsonProtoRes]`,
+		`nfourproto.FactoryHandleBizContext[proto.GetReq, rpc.User](impl.Get)`,
+	} {
+		if !strings.Contains(s, expect) {
+			t.Fatalf("generated code does not contain %s:\n%s", expect, s)
+		}
+	}
+
+	src = strings.Replace(src, `rpc "example.com/gen/rpcpb"`, `nfourrpc "example.com/gen/rpcpb"`, 1)
+	src = strings.Replace(src, `*rpc.User`, `*nfourrpc.User`, 1)
+	if _, err = generate([]byte(src), "user.go", "UserService", "user"); err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Fatalf("expect conflict error, got %v", err)
+	}
+}
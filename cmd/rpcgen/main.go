@@ -0,0 +1,70 @@
+// rpc stub generator basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+// rpcgen 根据go接口声明生成json rpc的服务端注册函数和类型化的客户端，一般通过 go generate 使用:
+//
+//	//go:generate go run github.com/rolandhe/saber/cmd/rpcgen -type EchoService -prefix echo
+//	type EchoService interface {
+//		Echo(req *EchoReq) (*EchoRes, error)
+//		Upper(ctx context.Context, req *EchoReq) (*EchoRes, error)
+//	}
+//
+// 接口方法的形式与 proto.RegisterService 相同，生成的代码包括:
+//
+// 1. RegisterEchoService(router, impl)，把每个方法以 prefix.Method 为方法名称注册到 json 协议的 SrvRouter
+//
+// 2. EchoServiceClient，基于 proto.JsonClient 实现了 EchoService 接口，通过 NewEchoServiceClient 构建
+//
+// 生成的代码以别名 nfourduplex、nfourrpc、nfourproto 导入nfour的包，避免与请求和响应类型所在的包同名
+//
+// 参数:
+//
+//	-type   接口名称，必须
+//	-prefix rpc方法名称的前缀，缺省为接口名称
+//	-source 接口所在的源文件，缺省为 go generate 设置的 $GOFILE
+//	-output 输出文件，缺省为 接口名称小写_rpc.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	typeName := flag.String("type", "", "interface name")
+	prefix := flag.String("prefix", "", "rpc key prefix, default is the interface name")
+	source := flag.String("source", os.Getenv("GOFILE"), "source file declaring the interface")
+	output := flag.String("output", "", "output file, default is <type>_rpc.go")
+	flag.Parse()
+
+	if *typeName == "" || *source == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *prefix == "" {
+		*prefix = *typeName
+	}
+	if *output == "" {
+		*output = filepath.Join(filepath.Dir(*source), strings.ToLower(*typeName)+"_rpc.go")
+	}
+
+	src, err := os.ReadFile(*source)
+	if err != nil {
+		fail(err)
+	}
+	code, err := generate(src, *source, *typeName, *prefix)
+	if err != nil {
+		fail(err)
+	}
+	if err = os.WriteFile(*output, code, 0644); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "rpcgen:", err)
+	os.Exit(1)
+}
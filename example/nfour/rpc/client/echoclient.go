@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/rolandhe/saber/example/nfour/rpc/server/handler"
 	"github.com/rolandhe/saber/nfour"
@@ -41,11 +42,14 @@ func core(name string) {
 		return
 	}
 
-	client := proto.NewJsonRpcClient(t)
+	client := handler.NewEchoServiceClient(proto.NewJsonRpcClient(t))
+	client.ReqTimeout = &duplex.ReqTimeout{
+		WaitConcurrent: time.Millisecond * 1000,
+	}
 
 	concurrentSend(50000, client)
 
-	client.Shutdown(name + "-main")
+	t.Shutdown(name + "-main")
 
 }
 
@@ -54,11 +58,8 @@ type req struct {
 	sortId int
 }
 
-func concurrentSend(taskCount int, c proto.JsonClient) {
+func concurrentSend(taskCount int, c *handler.EchoServiceClient) {
 	reqs := buildRequests(taskCount)
-	reqTimeout := &duplex.ReqTimeout{
-		WaitConcurrent: time.Millisecond * 1000,
-	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(taskCount)
@@ -71,12 +72,12 @@ func concurrentSend(taskCount int, c proto.JsonClient) {
 	trigger := sync.WaitGroup{}
 	trigger.Add(1)
 	for _, req := range reqs {
-		go func(r *proto.JsonProtoReq) {
+		go func(r *handler.EchoReq) {
 			trigger.Wait()
 			s := ""
 			tryCount := 0
 			for {
-				resp, err := c.SendRequest(r, reqTimeout)
+				jsonResult, err := c.Test(context.Background(), r)
 				if err != nil {
 					s = "err:" + "###" + err.Error()
 					if tryCount < 2 {
@@ -86,9 +87,6 @@ func concurrentSend(taskCount int, c proto.JsonClient) {
 						break
 					}
 				} else {
-					jsonResult, _ := proto.ParseJsonProtoRes[handler.Result[string]](resp, func() *handler.Result[string] {
-						return &handler.Result[string]{}
-					})
 					if jsonResult.Code == 500 {
 						s = "err:" + "###" + jsonResult.Message
 					} else {
@@ -148,12 +146,12 @@ func convertBatchResult(res []string) []*req {
 	return array
 }
 
-func buildRequests(num int) []*proto.JsonProtoReq {
-	var ret []*proto.JsonProtoReq
+func buildRequests(num int) []*handler.EchoReq {
+	var ret []*handler.EchoReq
 	for i := 0; i < num; i++ {
 		num := fmt.Sprintf("%08d", i)
 		v := "hello worldjjjjjjjjjjjjjjkadsjfkdjlasfjkldklsafjkdsafjkldsajlfjkdsajkfdjksafjkldjkslafjkldsajkfjkldsajkfjkdlsajkfdjkasfjkdsajkfjkldsajklfdjksafjkdjkasfjkdasjkfjkldsajkfjkdlasjfkfdasjkfjdklasfjkdsaf ok-" + num
-		ret = append(ret, &proto.JsonProtoReq{"rpc.test", []byte(v)})
+		ret = append(ret, &handler.EchoReq{Msg: v})
 	}
 	return ret
 }
@@ -0,0 +1,43 @@
+// Code generated by rpcgen. DO NOT EDIT.
+
+package handler
+
+import (
+	"context"
+	nfourduplex "github.com/rolandhe/saber/nfour/duplex"
+	nfourrpc "github.com/rolandhe/saber/nfour/rpc"
+	nfourproto "github.com/rolandhe/saber/nfour/rpc/proto"
+)
+
+// RegisterEchoService 把 EchoService 的方法注册到 router，opts 应用于所有的方法，使用 context.Context 的方法通过 ctx 获取 nfourrpc.WithTimeout 设置的截止时间
+func RegisterEchoService(router *nfourrpc.SrvRouter[nfourproto.JsonProtoReq, nfourproto.JsonProtoRes], impl EchoService, opts ...nfourrpc.RouteOption) {
+	router.RegisterContext("rpc.Test", nfourproto.FactoryHandleBizContext[EchoReq, Result[string]](impl.Test), opts...)
+}
+
+// EchoServiceClient 基于 nfourproto.JsonClient 的 EchoService 客户端
+type EchoServiceClient struct {
+	client nfourproto.JsonClient
+	// ReqTimeout 缺省的请求超时设置，nil表示使用底层 Transport 的配置，使用 context.Context 的方法中 ctx 的截止时间是 ReadTimeout 的上限，见 nfourproto.CallContext
+	ReqTimeout *nfourduplex.ReqTimeout
+}
+
+var _ EchoService = (*EchoServiceClient)(nil)
+
+// NewEchoServiceClient 构建 EchoService 客户端
+func NewEchoServiceClient(client nfourproto.JsonClient) *EchoServiceClient {
+	return &EchoServiceClient{client: client}
+}
+
+// reqTimeout 每次请求使用 ReqTimeout 的拷贝，底层 Transport 会修改 ReqTimeout
+func (c *EchoServiceClient) reqTimeout() *nfourduplex.ReqTimeout {
+	if c.ReqTimeout == nil {
+		return nil
+	}
+	rt := *c.ReqTimeout
+	return &rt
+}
+
+// Test 调用 rpc.Test
+func (c *EchoServiceClient) Test(ctx context.Context, req *EchoReq) (*Result[string], error) {
+	return nfourproto.CallContext[EchoReq, Result[string]](ctx, c.client, "rpc.Test", req, c.reqTimeout())
+}
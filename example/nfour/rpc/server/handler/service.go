@@ -0,0 +1,24 @@
+package handler
+
+//go:generate go run github.com/rolandhe/saber/cmd/rpcgen -type EchoService -prefix rpc
+
+import "context"
+
+// EchoService 示例服务，rpcgen 根据该接口生成 RegisterEchoService 和 EchoServiceClient
+type EchoService interface {
+	Test(ctx context.Context, req *EchoReq) (*Result[string], error)
+}
+
+type EchoReq struct {
+	Msg string `json:"msg"`
+}
+
+type echoService struct {
+}
+
+func (s *echoService) Test(ctx context.Context, req *EchoReq) (*Result[string], error) {
+	return &Result[string]{
+		Code: 200,
+		Data: req.Msg,
+	}, nil
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/rolandhe/saber/nfour"
 	"github.com/rolandhe/saber/nfour/duplex"
 	randutil "github.com/rolandhe/saber/utils/rand"
 	"github.com/rolandhe/saber/utils/sortutil"
@@ -16,7 +18,7 @@ func main() {
 	fmt.Println(reqs)
 
 	conf := duplex.NewTransConf(time.Minute*2, 200)
-	c, err := duplex.NewTrans("localhost:11011", conf)
+	c, err := duplex.NewTrans("localhost:11011", conf, "trans-example")
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -24,7 +26,7 @@ func main() {
 
 	concurrentSend(1000, c)
 
-	c.Shutdown()
+	c.Shutdown("main")
 }
 
 func concurrentSend(concur int, c *duplex.Trans) {
@@ -45,7 +47,9 @@ func concurrentSend(concur int, c *duplex.Trans) {
 			resp, err := c.SendPayload([]byte(v), reqTimeout)
 
 			s := ""
-			if err != nil {
+			if errors.Is(err, nfour.ExceedConcurrentError) {
+				s = "overloaded###" + err.Error()
+			} else if err != nil {
 				s = err.Error() + "###" + err.Error()
 			} else {
 				s = string(resp)
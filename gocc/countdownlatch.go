@@ -17,6 +17,8 @@
 // # Semaphore，信号量
 //
 // CountdownLatch， 倒计数
+//
+// RateLimiter，QPS限流器，包括令牌桶和漏桶两种实现
 package gocc
 
 import (
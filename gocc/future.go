@@ -25,6 +25,12 @@ func NewFutureGroup(count uint64) *FutureGroup {
 	}
 }
 
+// NewPendingFuture 构建一个没有关联任务的Future，由持有者在得到结果后调用 Complete 设置结果，
+// 适用于结果由其他方式产生，比如多个等待者共享一次调用结果的场景
+func NewPendingFuture() *Future {
+	return newFuture()
+}
+
 func newFuture() *Future {
 	return &Future{
 		ch: make(chan struct{}),
@@ -54,6 +60,7 @@ type Future struct {
 	result        *taskResult
 	groupNotifier *CountdownLatch
 	canceledFlag  atomic.Bool
+	completed     atomic.Bool
 }
 
 // Get 等待结果返回,如果已经调用Cancel方法,则err是TaskCancelledError
@@ -110,12 +117,21 @@ func (f *Future) GetTimeout(d time.Duration) (any, error) {
 	}
 }
 
-func (f *Future) accept(v *taskResult) {
+// Complete 设置 NewPendingFuture 构建的Future的结果，唤醒所有的等待者，只有第一次调用生效，返回是否生效
+func (f *Future) Complete(r any, err error) bool {
+	return f.accept(&taskResult{r, err})
+}
+
+func (f *Future) accept(v *taskResult) bool {
+	if !f.completed.CompareAndSwap(false, true) {
+		return false
+	}
 	f.result = v
 	close(f.ch)
 	if f.groupNotifier != nil {
 		f.groupNotifier.Down()
 	}
+	return true
 }
 
 // FutureGroup 用于批量管理任务的组件, 需要同时执行一批任务再等待他们的执行结果的场景可以是FutureGroup, 你可以先设置需要执行任务的个数,然后逐个的加入待执行任务,最后在FutureGroup上等待执行结果.
@@ -0,0 +1,122 @@
+// Golang concurrent tools like java juc.
+//
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package gocc
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter 限流器，限制单位时间内可以通过的请求数(QPS)，与 Semaphore 限制并发数不同，它获取的许可不需要释放
+type RateLimiter interface {
+	// TryAcquire 尝试获取一个许可,如果当下没有许可,则直接返回false
+	TryAcquire() bool
+
+	// AcquireTimeout 超时获取许可,如果超时时间内无法获得许可则立即返回false,否则等待到许可可用后返回true
+	//
+	//d == 0 退化成 TryAcquire
+	//
+	//d < 0 一直等待直到获得许可
+	AcquireTimeout(d time.Duration) bool
+}
+
+// NewTokenBucketLimiter 构建令牌桶限流器，令牌以 qps 的速度放入桶中，桶内最多存放 burst 个令牌，允许短时间的突发流量
+//
+//	qps  每秒产生的令牌数，必须大于0
+//	burst 桶的容量，小于1时按1处理
+func NewTokenBucketLimiter(qps float64, burst uint) RateLimiter {
+	if !(qps > 0) {
+		panic("invalid qps value")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   qps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// NewLeakyBucketLimiter 构建漏桶限流器，请求以固定的时间间隔(1/qps)匀速通过，不允许突发流量
+//
+//	qps  每秒允许通过的请求数，必须大于0
+func NewLeakyBucketLimiter(qps float64) RateLimiter {
+	if !(qps > 0) {
+		panic("invalid qps value")
+	}
+	return &leakyBucket{
+		interval: time.Duration(float64(time.Second) / qps),
+	}
+}
+
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) TryAcquire() bool {
+	return tb.AcquireTimeout(0)
+}
+
+// AcquireTimeout 令牌不足时预支一个令牌，计算出令牌补足需要的等待时间，等待时间不超过d时睡眠等待，否则归还预支
+func (tb *tokenBucket) AcquireTimeout(d time.Duration) bool {
+	tb.lock.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	tb.tokens--
+	if tb.tokens >= 0 {
+		tb.lock.Unlock()
+		return true
+	}
+	wait := time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	if d >= 0 && wait > d {
+		tb.tokens++
+		tb.lock.Unlock()
+		return false
+	}
+	tb.lock.Unlock()
+	time.Sleep(wait)
+	return true
+}
+
+type leakyBucket struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (lb *leakyBucket) TryAcquire() bool {
+	return lb.AcquireTimeout(0)
+}
+
+// AcquireTimeout 每个请求占用一个时间槽，槽位之间间隔 interval，请求需要等待到自己的槽位才能通过
+func (lb *leakyBucket) AcquireTimeout(d time.Duration) bool {
+	lb.lock.Lock()
+	now := time.Now()
+	slot := lb.next
+	if slot.Before(now) {
+		slot = now
+	}
+	wait := slot.Sub(now)
+	if d >= 0 && wait > d {
+		lb.lock.Unlock()
+		return false
+	}
+	lb.next = slot.Add(lb.interval)
+	lb.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return true
+}
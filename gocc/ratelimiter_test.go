@@ -0,0 +1,54 @@
+package gocc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurst(t *testing.T) {
+	limiter := NewTokenBucketLimiter(10, 3)
+	for i := 0; i < 3; i++ {
+		if !limiter.TryAcquire() {
+			t.Fatalf("burst token %d should be available", i)
+		}
+	}
+	if limiter.TryAcquire() {
+		t.Fatalf("bucket should be empty")
+	}
+	if !limiter.AcquireTimeout(time.Millisecond * 200) {
+		t.Fatalf("token should be refilled within 200ms")
+	}
+}
+
+func TestLeakyBucketInterval(t *testing.T) {
+	limiter := NewLeakyBucketLimiter(20)
+	if !limiter.TryAcquire() {
+		t.Fatalf("first request should pass")
+	}
+	if limiter.TryAcquire() {
+		t.Fatalf("leaky bucket should not allow burst")
+	}
+	start := time.Now()
+	if !limiter.AcquireTimeout(time.Millisecond * 100) {
+		t.Fatalf("request should pass after interval")
+	}
+	if cost := time.Since(start); cost < time.Millisecond*30 {
+		t.Fatalf("request passed too early: %v", cost)
+	}
+}
+
+func TestRateLimiterRejectsInvalidQps(t *testing.T) {
+	for _, build := range []func(){
+		func() { NewTokenBucketLimiter(0, 1) },
+		func() { NewLeakyBucketLimiter(-1) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expect panic for invalid qps")
+				}
+			}()
+			build()
+		}()
+	}
+}
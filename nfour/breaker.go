@@ -0,0 +1,295 @@
+// net framework basing tcp, tcp is 4th layer of osi net model
+//
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package nfour
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen 熔断器处于打开状态，请求被快速失败，没有被发送
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState 熔断器状态
+type BreakerState int32
+
+const (
+	// BreakerClosed 关闭状态，请求正常通过
+	BreakerClosed BreakerState = iota
+	// BreakerOpen 打开状态，所有请求快速失败
+	BreakerOpen
+	// BreakerHalfOpen 半开状态，允许少量试探请求通过，根据试探结果决定关闭或者重新打开
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerConf 熔断器配置
+type BreakerConf struct {
+	// WindowSize 统计最近多少次调用的结果
+	WindowSize int
+	// MinCalls 窗口内至少有多少次调用才会计算失败率，避免少量调用导致误判
+	MinCalls int
+	// FailureRateThreshold 失败率阈值，0-1之间，达到后熔断器打开, 小于等于0表示不根据失败率熔断
+	FailureRateThreshold float64
+	// SlowCallDuration 耗时超过该时间的调用被认为是慢调用
+	SlowCallDuration time.Duration
+	// SlowCallRateThreshold 慢调用比例阈值，0-1之间，达到后熔断器打开, 小于等于0表示不根据慢调用熔断
+	SlowCallRateThreshold float64
+	// OpenDuration 打开状态持续的时间，超过后进入半开状态
+	OpenDuration time.Duration
+	// HalfOpenCalls 半开状态允许通过的试探请求数
+	HalfOpenCalls int
+	// IsFailure 判断一次调用是否失败，nil表示使用 DefaultBreakerFailure
+	IsFailure func(err error) bool
+}
+
+// NewBreakerConf 构建缺省的熔断器配置: 最近100次调用中失败率达到50%或者超过 slowCall 的慢调用达到80%时打开，打开5秒后进入半开状态，允许10个试探请求
+func NewBreakerConf(slowCall time.Duration) *BreakerConf {
+	return &BreakerConf{
+		WindowSize:            100,
+		MinCalls:              20,
+		FailureRateThreshold:  0.5,
+		SlowCallDuration:      slowCall,
+		SlowCallRateThreshold: 0.8,
+		OpenDuration:          time.Second * 5,
+		HalfOpenCalls:         10,
+	}
+}
+
+// DefaultBreakerFailure 缺省的失败判断，请求不合法、方法不存在是调用方的问题，被调用方取消(比如对冲请求中较慢的请求)与下游无关，都不被认为是下游失败
+func DefaultBreakerFailure(err error) bool {
+	if err == nil || errors.Is(err, ErrTaskCancelled) {
+		return false
+	}
+	status := StatusOf(err)
+	return status != StatusBadRequest && status != StatusNotFound
+}
+
+// BreakerMetrics 熔断器的监控数据
+type BreakerMetrics struct {
+	State BreakerState
+	// Calls 当前统计窗口内的调用数
+	Calls int
+	// Failures 当前统计窗口内的失败数
+	Failures int
+	// SlowCalls 当前统计窗口内的慢调用数
+	SlowCalls int
+	// Rejected 熔断器创建以来被快速失败的请求总数
+	Rejected uint64
+}
+
+// BreakerTicket 熔断器放行请求时发放的凭证，请求结束后需要通过 CircuitBreaker.Done 归还
+type BreakerTicket struct {
+	gen   uint64
+	start time.Time
+}
+
+const (
+	outcomeFailure = 1 << iota
+	outcomeSlow
+)
+
+// NewCircuitBreaker 构建熔断器
+// name 熔断器名称，状态变化时会输出到日志。
+// conf 被复制后再补充缺省值，同一个 conf 可以被多个熔断器共享；conf 为nil时使用 NewBreakerConf(0)，不统计慢调用
+func NewCircuitBreaker(conf *BreakerConf, name string) *CircuitBreaker {
+	if conf == nil {
+		conf = NewBreakerConf(0)
+	}
+	copied := *conf
+	conf = &copied
+	if conf.WindowSize <= 0 {
+		conf.WindowSize = 1
+	}
+	if conf.HalfOpenCalls <= 0 {
+		conf.HalfOpenCalls = 1
+	}
+	if conf.HalfOpenCalls > conf.WindowSize {
+		conf.HalfOpenCalls = conf.WindowSize
+	}
+	if conf.IsFailure == nil {
+		conf.IsFailure = DefaultBreakerFailure
+	}
+	return &CircuitBreaker{
+		conf:     conf,
+		name:     name,
+		outcomes: make([]byte, conf.WindowSize),
+	}
+}
+
+// CircuitBreaker 基于滑动窗口的熔断器，支持关闭、打开、半开三种状态，根据失败率和慢调用比例打开熔断器。
+// 关闭状态下统计最近 WindowSize 次调用的结果；打开状态下所有请求快速失败并返回 ErrCircuitOpen；打开 OpenDuration 后进入半开状态，
+// 放行 HalfOpenCalls 个试探请求，试探结果没有超出阈值则关闭熔断器，否则重新打开
+type CircuitBreaker struct {
+	conf *BreakerConf
+	name string
+
+	lock     sync.Mutex
+	state    BreakerState
+	gen      uint64
+	openedAt time.Time
+	permits  int
+
+	outcomes []byte
+	pos      int
+	calls    int
+	failures int
+	slows    int
+	rejected uint64
+}
+
+// Allow 判断请求是否可以通过，可以通过时返回凭证，否则返回 ErrCircuitOpen
+func (b *CircuitBreaker) Allow() (*BreakerTicket, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.refreshState(now)
+	switch b.state {
+	case BreakerOpen:
+		b.rejected++
+		return nil, ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.permits >= b.conf.HalfOpenCalls {
+			b.rejected++
+			return nil, ErrCircuitOpen
+		}
+		b.permits++
+	}
+	return &BreakerTicket{gen: b.gen, start: now}, nil
+}
+
+// Done 记录请求的结果，ticket 必须是 Allow 返回的凭证，状态变化前发放的凭证会被忽略。
+// 被调用方取消的请求(ErrTaskCancelled)没有结果，不记录到统计窗口，半开状态下归还试探名额
+func (b *CircuitBreaker) Done(ticket *BreakerTicket, err error) {
+	if errors.Is(err, ErrTaskCancelled) {
+		b.cancel(ticket)
+		return
+	}
+	cost := time.Since(ticket.start)
+	var outcome byte
+	if b.conf.IsFailure(err) {
+		outcome |= outcomeFailure
+	}
+	if b.conf.SlowCallDuration > 0 && cost >= b.conf.SlowCallDuration {
+		outcome |= outcomeSlow
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ticket.gen != b.gen {
+		return
+	}
+	b.record(outcome)
+	switch b.state {
+	case BreakerClosed:
+		if b.calls >= b.conf.MinCalls && b.exceedThreshold() {
+			b.transfer(BreakerOpen, time.Now())
+		}
+	case BreakerHalfOpen:
+		if b.calls < b.conf.HalfOpenCalls {
+			return
+		}
+		if b.exceedThreshold() {
+			b.transfer(BreakerOpen, time.Now())
+		} else {
+			b.transfer(BreakerClosed, time.Now())
+		}
+	}
+}
+
+func (b *CircuitBreaker) cancel(ticket *BreakerTicket) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if ticket.gen == b.gen && b.state == BreakerHalfOpen && b.permits > 0 {
+		b.permits--
+	}
+}
+
+// State 获取熔断器当前状态
+func (b *CircuitBreaker) State() BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refreshState(time.Now())
+	return b.state
+}
+
+// Metrics 获取熔断器的监控数据
+func (b *CircuitBreaker) Metrics() BreakerMetrics {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refreshState(time.Now())
+	return BreakerMetrics{
+		State:     b.state,
+		Calls:     b.calls,
+		Failures:  b.failures,
+		SlowCalls: b.slows,
+		Rejected:  b.rejected,
+	}
+}
+
+func (b *CircuitBreaker) refreshState(now time.Time) {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.conf.OpenDuration {
+		b.transfer(BreakerHalfOpen, now)
+	}
+}
+
+func (b *CircuitBreaker) exceedThreshold() bool {
+	if b.calls == 0 {
+		return false
+	}
+	if b.conf.FailureRateThreshold > 0 && float64(b.failures)/float64(b.calls) >= b.conf.FailureRateThreshold {
+		return true
+	}
+	return b.conf.SlowCallRateThreshold > 0 && float64(b.slows)/float64(b.calls) >= b.conf.SlowCallRateThreshold
+}
+
+func (b *CircuitBreaker) record(outcome byte) {
+	if b.calls == len(b.outcomes) {
+		old := b.outcomes[b.pos]
+		if old&outcomeFailure != 0 {
+			b.failures--
+		}
+		if old&outcomeSlow != 0 {
+			b.slows--
+		}
+	} else {
+		b.calls++
+	}
+	b.outcomes[b.pos] = outcome
+	b.pos = (b.pos + 1) % len(b.outcomes)
+	if outcome&outcomeFailure != 0 {
+		b.failures++
+	}
+	if outcome&outcomeSlow != 0 {
+		b.slows++
+	}
+}
+
+// transfer 状态变化时清空统计窗口，并使之前发放的凭证失效
+func (b *CircuitBreaker) transfer(state BreakerState, now time.Time) {
+	NFourLogger.Info("circuit breaker %s: %s -> %s\n", b.name, b.state, state)
+	b.state = state
+	b.gen++
+	b.permits = 0
+	b.pos = 0
+	b.calls = 0
+	b.failures = 0
+	b.slows = 0
+	if state == BreakerOpen {
+		b.openedAt = now
+	}
+}
@@ -0,0 +1,75 @@
+package nfour
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerOpenAndRecover(t *testing.T) {
+	conf := &BreakerConf{
+		WindowSize:           10,
+		MinCalls:             4,
+		FailureRateThreshold: 0.5,
+		OpenDuration:         time.Millisecond * 50,
+		HalfOpenCalls:        2,
+	}
+	b := NewCircuitBreaker(conf, "test")
+	failed := errors.New("failed")
+	for i := 0; i < 4; i++ {
+		ticket, err := b.Allow()
+		if err != nil {
+			t.Fatalf("closed breaker rejected request: %v", err)
+		}
+		b.Done(ticket, failed)
+	}
+	if b.State() != BreakerOpen {
+		t.Fatalf("expect open, got %s", b.State())
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expect ErrCircuitOpen, got %v", err)
+	}
+
+	time.Sleep(conf.OpenDuration)
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("expect half-open, got %s", b.State())
+	}
+	t1, _ := b.Allow()
+	t2, _ := b.Allow()
+	if _, err := b.Allow(); err == nil {
+		t.Fatalf("half-open breaker should only permit %d calls", conf.HalfOpenCalls)
+	}
+	b.Done(t1, nil)
+	b.Done(t2, nil)
+	if b.State() != BreakerClosed {
+		t.Fatalf("expect closed, got %s", b.State())
+	}
+}
+
+func TestCircuitBreakerIgnoreCallerErrors(t *testing.T) {
+	b := NewCircuitBreaker(&BreakerConf{WindowSize: 4, MinCalls: 1, FailureRateThreshold: 0.1}, "test")
+	ticket, _ := b.Allow()
+	b.Done(ticket, NewStatusError(StatusNotFound, "rpc.none"))
+	if b.State() != BreakerClosed {
+		t.Fatalf("not found should not open breaker")
+	}
+}
+
+func TestCircuitBreakerSharedConf(t *testing.T) {
+	conf := &BreakerConf{FailureRateThreshold: 0.5}
+	for i := 0; i < 2; i++ {
+		NewCircuitBreaker(conf, "test")
+	}
+	if conf.WindowSize != 0 || conf.HalfOpenCalls != 0 || conf.IsFailure != nil {
+		t.Fatalf("conf should not be modified: %+v", conf)
+	}
+	b := NewCircuitBreaker(nil, "test")
+	ticket, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Done(ticket, errors.New("failed"))
+	if b.Metrics().Failures != 1 {
+		t.Fatalf("expect 1 failure, got %+v", b.Metrics())
+	}
+}
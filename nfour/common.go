@@ -15,31 +15,123 @@ package nfour
 
 import (
 	"errors"
+	"fmt"
 	"github.com/rolandhe/saber/gocc"
+	"github.com/rolandhe/saber/utils/bytutil"
 	"io"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
 const (
 	// PayLoadLenBufLength header中的首4个字节，用于记录header后面数据负载的长度
-	// header格式：4个字节 + 8个字节 + n个字节的payload， 其中首4个字节里存储 n，8个字节表示request id， 最后的n个字节表示request 数据
+	// 多路复用模式下header格式：4个字节 + 8个字节 + 1个字节 + n个字节的payload， 其中首4个字节里存储 n，最高位固定为1作为协议标识，
+	// 8个字节表示request id，1个字节表示帧状态码(见 Status)， 最后的n个字节表示request 数据
 	PayLoadLenBufLength = 4
 )
 
+// MaxPayloadLength 单个帧负载的最大长度，读取到超出该长度或者为负数的长度时，认为header已经损坏，连接会被关闭
+var MaxPayloadLength = 64 * 1024 * 1024
+
 var (
 	// PeerCloseError 连接的另一头已经关闭连接
 	PeerCloseError = errors.New("peer closed")
 	// ExceedConcurrentError 当前的请求已经超出设定的最大并发数
 	ExceedConcurrentError = errors.New("exceed concurrent")
-	defaultSemaWaitTime   = time.Millisecond
+	// ExceedRateLimitError 当前的请求已经超出设定的QPS限制, 与 ExceedConcurrentError 一样以过载状态返回给客户端
+	ExceedRateLimitError = errors.New("exceed rate limit")
+	defaultSemaWaitTime  = time.Millisecond
+
+	// ErrTaskTimeout 客户端请求执行超时异常
+	ErrTaskTimeout = errors.New("task execute timeout")
+	// ErrTaskCancelled 客户端请求在收到响应前被调用方取消
+	ErrTaskCancelled = errors.New("task cancelled")
+	// ErrTransShutdown 客户端已经被关闭
+	ErrTransShutdown = errors.New("transport shut down")
+	// ErrTransShutdownInFlight 请求等待响应时客户端被关闭，请求可能已经被发送到服务端，errors.Is(err, ErrTransShutdown) 同样成立
+	ErrTransShutdownInFlight = fmt.Errorf("%w, request may have been sent", ErrTransShutdown)
+	// ErrInvalidPayloadLength header中的负载长度非法，一般是header被损坏
+	ErrInvalidPayloadLength = errors.New("invalid payload length")
 )
 
+// ReqTimeout 客户端请求超时信息
+type ReqTimeout struct {
+	// ReadTimeout 网络读取超时时间
+	ReadTimeout time.Duration
+	// WriteTimeout 网络写出超时
+	WriteTimeout time.Duration
+	// WaitConcurrent 当到达最大并发时，等待执行的超时时间
+	WaitConcurrent time.Duration
+}
+
 // Task 描述一个请求的数据, 这个请求会被封装成Task 交于任务执行器执行
 type Task struct {
 	// Payload 请求数据，二进制格式，可以被上层业务解析
 	PayLoad []byte
+
+	// release 释放请求占用的服务端并发，nil表示没有占用
+	release func()
+
+	lock     sync.Mutex
+	holds    int
+	done     bool
+	released bool
+}
+
+// NewTask 构建 Task，release 用于释放请求占用的服务端并发，由通信层调用 Task.Done 触发
+func NewTask(payload []byte, release func()) *Task {
+	return &Task{PayLoad: payload, release: release}
+}
+
+// Hold 接管请求占用的服务端并发，用于 WorkingFunc 返回后业务处理仍在继续执行的场景，比如业务处理超时。
+// 每次调用增加一个持有者，返回的函数在业务处理真正结束时调用，多次调用只生效一次；Done 被调用并且所有持有者都结束后才释放并发。
+// 可以多次调用，比如批量请求中的多个请求共享批量请求的并发；Hold 需要在 WorkingFunc 返回之前调用
+func (t *Task) Hold() func() {
+	if t == nil || t.release == nil {
+		return func() {}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.released {
+		return func() {}
+	}
+	t.holds++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.lock.Lock()
+			t.holds--
+			t.releaseIfIdle()
+		})
+	}
+}
+
+// Done 通信层在请求处理完成后调用，没有持有者时释放请求占用的服务端并发，否则由最后一个持有者释放，多次调用只生效一次
+func (t *Task) Done() {
+	if t == nil || t.release == nil {
+		return
+	}
+	t.lock.Lock()
+	if t.done {
+		t.lock.Unlock()
+		return
+	}
+	t.done = true
+	t.releaseIfIdle()
+}
+
+// releaseIfIdle 需要持有锁，返回前释放锁，Done 已经被调用并且没有持有者时释放并发
+func (t *Task) releaseIfIdle() {
+	fire := t.done && t.holds == 0 && !t.released
+	if fire {
+		t.released = true
+	}
+	t.lock.Unlock()
+	if fire {
+		t.release()
+	}
 }
 
 // WorkingFunc 请求的处理函数，请求数据会被解析，执行业务逻辑，生成业务结果，业务结果被转换成二进制格式返回
@@ -58,6 +150,7 @@ func NewSrvConf(working WorkingFunc, errHandle HandleError, concurrent uint) *Sr
 		time.Millisecond * 2000,
 		time.Minute * 10,
 		defaultSemaWaitTime,
+		nil,
 		gocc.NewDefaultSemaphore(concurrent),
 	}
 }
@@ -78,6 +171,7 @@ func NewSrvConfSemaWait(working WorkingFunc, errHandle HandleError, concurrent u
 		time.Millisecond * 2000,
 		time.Minute * 10,
 		semaWaitTime,
+		nil,
 		gocc.NewDefaultSemaphore(concurrent),
 	}
 }
@@ -86,7 +180,7 @@ func NewSrvConfSemaWait(working WorkingFunc, errHandle HandleError, concurrent u
 //
 //	Working 请求处理函数
 //
-// # ErrHandle 出错信息出来
+// # ErrHandle 出错信息出来, 单路模式下使用它把err转换成响应数据; 多路复用模式下err会被转换成帧状态码(见 StatusOf)和错误信息返回给客户端
 //
 // SemaWaitTime 如果当前已经到达最大并发，当前请求等待被执行的超时时间
 type SrvConf struct {
@@ -96,7 +190,9 @@ type SrvConf struct {
 	WriteTimeout time.Duration
 	IdleTimeout  time.Duration
 	SemaWaitTime time.Duration
-	concurrent   gocc.Semaphore
+	// Limiter 可选的QPS限流器，请求在获取并发信号量之前先获取限流许可，获取不到时立即返回 ExceedRateLimitError
+	Limiter    gocc.RateLimiter
+	concurrent gocc.Semaphore
 }
 
 // GetConcurrent 获取当前服务配置的最大并发数的信号量
@@ -104,9 +200,17 @@ func (conf *SrvConf) GetConcurrent() gocc.Semaphore {
 	return conf.concurrent
 }
 
+// AdmitRate 请求是否通过了QPS限流，没有设置限流器时总是通过
+func (conf *SrvConf) AdmitRate() bool {
+	return conf.Limiter == nil || conf.Limiter.TryAcquire()
+}
+
 // InternalReadPayload 从连接中读取指定长度的数据， 主要是内部使用
 // notHalt 当长时间读取不到数据且收到超时异常时，是不是不中断连接，true，不中断连接，继续读取
 func InternalReadPayload(conn net.Conn, buff []byte, expectLen int, notHalt bool) error {
+	if expectLen == 0 {
+		return nil
+	}
 	l := 0
 	for {
 		n, err := conn.Read(buff)
@@ -130,3 +234,15 @@ func InternalReadPayload(conn net.Conn, buff []byte, expectLen int, notHalt bool
 	}
 	return nil
 }
+
+// InternalPayloadLength 从header的首4个字节中解析负载长度，长度为负数或者超过 MaxPayloadLength 时返回 ErrInvalidPayloadLength， 主要是内部使用
+func InternalPayloadLength(header []byte) (int, error) {
+	l, err := bytutil.ToInt32(header[:PayLoadLenBufLength])
+	if err != nil {
+		return 0, err
+	}
+	if l < 0 || int(l) > MaxPayloadLength {
+		return 0, ErrInvalidPayloadLength
+	}
+	return int(l), nil
+}
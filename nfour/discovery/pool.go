@@ -0,0 +1,231 @@
+// service discovery basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package discovery
+
+import (
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoEndpoint 连接池内没有可用的连接
+var ErrNoEndpoint = errors.New("no available endpoint")
+
+// redialInterval 同一个地址两次重连之间的最小间隔，避免下游不可用时频繁建立连接
+const redialInterval = time.Second
+
+// DialTimeout 连接池建立连接的超时时间，连接在后台建立，不可达的地址不会阻塞地址更新和其他地址的请求
+var DialTimeout = time.Second * 3
+
+// NewTransPool 构建连接池，并开始监听 resolver 的地址变化，返回前会并行的为当前地址建立连接，最多等待 DialTimeout
+//
+// confFactory 为每个地址构建 duplex.TransConf，每个 Trans 需要独立的配置，因为配置中包含并发信号量和熔断器
+//
+// name 连接池名称，会作为 Trans 名称的前缀输出到日志
+func NewTransPool(resolver Resolver, confFactory func(addr string) *duplex.TransConf, name string) (*TransPool, error) {
+	p := &TransPool{
+		resolver:    resolver,
+		confFactory: confFactory,
+		name:        name,
+		entries:     map[string]*poolEntry{},
+	}
+	p.snapshot.Store([]*poolEntry{})
+	if err := resolver.Watch(p.update); err != nil {
+		return nil, err
+	}
+	for _, e := range p.snapshot.Load().([]*poolEntry) {
+		<-e.ready
+	}
+	return p, nil
+}
+
+// TransPool 基于 Resolver 的 duplex.Trans 连接池，每个地址对应一个 Trans。请求被轮询的发送到可用的 Trans 上，
+// 新增的地址在后台建立连接，连接建立之前的地址不会被选中；被关闭的 Trans(比如连接断开)会在下次被选中时异步重连
+type TransPool struct {
+	resolver    Resolver
+	confFactory func(addr string) *duplex.TransConf
+	name        string
+
+	lock     sync.Mutex
+	entries  map[string]*poolEntry
+	snapshot atomic.Value
+	next     atomic.Uint64
+	closed   atomic.Bool
+}
+
+type poolEntry struct {
+	addr     string
+	trans    atomic.Pointer[duplex.Trans]
+	dialing  atomic.Bool
+	lastDial atomic.Int64
+	removed  atomic.Bool
+	// ready 第一次建立连接结束(无论成功与否)后关闭
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// Endpoints 当前连接池内的地址列表
+func (p *TransPool) Endpoints() []string {
+	entries := p.snapshot.Load().([]*poolEntry)
+	ret := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ret = append(ret, e.addr)
+	}
+	return ret
+}
+
+// Pick 轮询选择一个可用的 Trans，没有可用的 Trans 时返回 ErrNoEndpoint
+func (p *TransPool) Pick() (*duplex.Trans, error) {
+	if p.closed.Load() {
+		return nil, duplex.ErrTransShutdown
+	}
+	entries := p.snapshot.Load().([]*poolEntry)
+	n := uint64(len(entries))
+	start := p.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		e := entries[(start+i)%n]
+		t := e.trans.Load()
+		if t == nil || t.IsShutdown() {
+			p.redial(e)
+			continue
+		}
+		if t.IsAvailable() {
+			return t, nil
+		}
+	}
+	return nil, ErrNoEndpoint
+}
+
+// IsAvailable 连接池中是否存在可用的 Trans
+func (p *TransPool) IsAvailable() bool {
+	if p.closed.Load() {
+		return false
+	}
+	for _, e := range p.snapshot.Load().([]*poolEntry) {
+		if t := e.trans.Load(); t != nil && t.IsAvailable() {
+			return true
+		}
+	}
+	return false
+}
+
+// SendPayload 从连接池中选择一个 Trans 发送请求，参见 duplex.Trans.SendPayload
+func (p *TransPool) SendPayload(req []byte, reqTimeout *duplex.ReqTimeout) ([]byte, error) {
+	return p.SendPayloadCancel(req, reqTimeout, nil)
+}
+
+// SendPayloadCancel 从连接池中选择一个 Trans 发送请求，参见 duplex.Trans.SendPayloadCancel
+func (p *TransPool) SendPayloadCancel(req []byte, reqTimeout *duplex.ReqTimeout, cancel <-chan struct{}) ([]byte, error) {
+	t, err := p.Pick()
+	if err != nil {
+		return nil, err
+	}
+	return t.SendPayloadCancel(req, reqTimeout, cancel)
+}
+
+// Shutdown 停止监听地址变化，并关闭所有的 Trans
+func (p *TransPool) Shutdown(source string) {
+	if !p.closed.CompareAndSwap(false, true) {
+		return
+	}
+	p.resolver.Close()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for addr, e := range p.entries {
+		e.removed.Store(true)
+		if t := e.trans.Load(); t != nil {
+			t.Shutdown(source)
+		}
+		delete(p.entries, addr)
+	}
+	p.snapshot.Store([]*poolEntry{})
+}
+
+// update 根据最新的地址列表增加或者删除 Trans，持有锁时只修改地址列表，新地址在锁外异步建立连接，建立失败的地址在被选中时重连
+func (p *TransPool) update(endpoints []string) {
+	for _, e := range p.apply(endpoints) {
+		p.startDial(e)
+	}
+}
+
+// apply 更新地址列表，返回新增的地址。获取锁之后需要再次检查 closed，避免与 Shutdown 并发时在清空之后加入新的地址
+func (p *TransPool) apply(endpoints []string) []*poolEntry {
+	if p.closed.Load() {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed.Load() {
+		return nil
+	}
+	var added []*poolEntry
+	latest := make(map[string]struct{}, len(endpoints))
+	for _, addr := range endpoints {
+		latest[addr] = struct{}{}
+		if _, ok := p.entries[addr]; ok {
+			continue
+		}
+		e := &poolEntry{addr: addr, ready: make(chan struct{})}
+		p.entries[addr] = e
+		added = append(added, e)
+		nfour.NFourLogger.Info("trans pool %s add endpoint %s\n", p.name, addr)
+	}
+	for addr, e := range p.entries {
+		if _, ok := latest[addr]; ok {
+			continue
+		}
+		e.removed.Store(true)
+		if t := e.trans.Load(); t != nil {
+			t.Shutdown(p.name + "-resolver")
+		}
+		delete(p.entries, addr)
+		nfour.NFourLogger.Info("trans pool %s remove endpoint %s\n", p.name, addr)
+	}
+	snapshot := make([]*poolEntry, 0, len(p.entries))
+	for _, addr := range endpoints {
+		snapshot = append(snapshot, p.entries[addr])
+	}
+	p.snapshot.Store(snapshot)
+	return added
+}
+
+func (p *TransPool) dial(e *poolEntry) {
+	conn, err := net.DialTimeout("tcp", e.addr, DialTimeout)
+	if err != nil {
+		nfour.NFourLogger.Info("trans pool %s dial %s error:%v\n", p.name, e.addr, err)
+		return
+	}
+	t := duplex.NewTransWithConn(conn, p.confFactory(e.addr), p.name+"-"+e.addr)
+	e.trans.Store(t)
+	// 与 update 中的删除并发时，保证被删除地址的连接总能被关闭
+	if e.removed.Load() {
+		t.Shutdown(p.name + "-removed")
+	}
+}
+
+func (p *TransPool) redial(e *poolEntry) {
+	if e.removed.Load() || time.Now().UnixNano()-e.lastDial.Load() < int64(redialInterval) {
+		return
+	}
+	p.startDial(e)
+}
+
+// startDial 异步建立连接，同一个地址同时只有一个建立连接的goroutine
+func (p *TransPool) startDial(e *poolEntry) {
+	if !e.dialing.CompareAndSwap(false, true) {
+		return
+	}
+	e.lastDial.Store(time.Now().UnixNano())
+	go func() {
+		defer e.dialing.Store(false)
+		p.dial(e)
+		e.readyOnce.Do(func() {
+			close(e.ready)
+		})
+	}()
+}
@@ -0,0 +1,155 @@
+package discovery
+
+import (
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"net"
+	"testing"
+	"time"
+)
+
+func startEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	working := func(task *nfour.Task) ([]byte, error) {
+		return task.PayLoad, nil
+	}
+	go duplex.Serve(ln, nfour.NewSrvConf(working, func(err error) []byte { return nil }, 10))
+	return ln.Addr().String()
+}
+
+// unreachableAddr 已经关闭的监听地址，连接会被拒绝
+func unreachableAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func newTestPool(t *testing.T, resolver Resolver) *TransPool {
+	pool, err := NewTransPool(resolver, func(addr string) *duplex.TransConf {
+		return duplex.NewTransConf(time.Second, 10)
+	}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Shutdown("test") })
+	return pool
+}
+
+func entryOf(pool *TransPool, addr string) *poolEntry {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.entries[addr]
+}
+
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	deadline := time.Now().Add(time.Second * 2)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestTransPoolAddAndRemoveEndpoints(t *testing.T) {
+	addr1, addr2 := startEchoServer(t), startEchoServer(t)
+	resolver := NewManualResolver(addr1)
+	pool := newTestPool(t, resolver)
+
+	res, err := pool.SendPayload([]byte("hi"), nil)
+	if err != nil || string(res) != "hi" {
+		t.Fatalf("unexpected result %s %v", res, err)
+	}
+	old, _ := pool.Pick()
+
+	resolver.Update(addr1, addr2)
+	waitFor(t, func() bool {
+		tr := entryOf(pool, addr2).trans.Load()
+		return tr != nil && tr.IsAvailable()
+	}, "new endpoint not connected")
+
+	resolver.Update(addr2)
+	if eps := pool.Endpoints(); len(eps) != 1 || eps[0] != addr2 {
+		t.Fatalf("unexpected endpoints %v", eps)
+	}
+	if !old.IsShutdown() {
+		t.Fatal("trans of removed endpoint should be shut down")
+	}
+	for i := 0; i < 4; i++ {
+		if tr, err := pool.Pick(); err != nil || tr == old {
+			t.Fatalf("removed endpoint picked: %v", err)
+		}
+	}
+}
+
+func TestTransPoolRedialAfterDrop(t *testing.T) {
+	addr := startEchoServer(t)
+	pool := newTestPool(t, NewManualResolver(addr))
+	old, err := pool.Pick()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Shutdown("drop")
+	// 跳过重连间隔
+	entryOf(pool, addr).lastDial.Store(0)
+	if _, err = pool.Pick(); err != ErrNoEndpoint {
+		t.Fatalf("expect ErrNoEndpoint while redialing, got %v", err)
+	}
+	waitFor(t, func() bool {
+		tr, err := pool.Pick()
+		return err == nil && tr != old
+	}, "endpoint not redialed")
+}
+
+func TestTransPoolSkipUnavailable(t *testing.T) {
+	good, bad := startEchoServer(t), unreachableAddr(t)
+	start := time.Now()
+	pool := newTestPool(t, NewStaticResolver(bad, good))
+	if cost := time.Since(start); cost >= DialTimeout {
+		t.Fatalf("construction blocked by unreachable endpoint: %v", cost)
+	}
+	if !pool.IsAvailable() {
+		t.Fatal("pool should be available")
+	}
+	goodTrans := entryOf(pool, good).trans.Load()
+	for i := 0; i < 4; i++ {
+		tr, err := pool.Pick()
+		if err != nil || tr != goodTrans {
+			t.Fatalf("pick should skip unreachable endpoint: %v", err)
+		}
+	}
+}
+
+// 地址更新与 Shutdown 并发时，Shutdown 之后不会再加入新的地址和连接
+func TestTransPoolUpdateRaceShutdown(t *testing.T) {
+	addr1, addr2 := startEchoServer(t), startEchoServer(t)
+	pool := newTestPool(t, NewManualResolver(addr1))
+	pool.Shutdown("test")
+	pool.closed.Store(false)
+
+	// update 通过 closed 检查后阻塞在锁上，此时模拟 Shutdown 先获取锁并清空地址列表
+	pool.lock.Lock()
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		pool.update([]string{addr1, addr2})
+	}()
+	time.Sleep(time.Millisecond * 20)
+	pool.closed.Store(true)
+	pool.lock.Unlock()
+	<-updated
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if len(pool.entries) != 0 {
+		t.Fatalf("entries added after shutdown: %d", len(pool.entries))
+	}
+}
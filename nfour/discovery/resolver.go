@@ -0,0 +1,232 @@
+// service discovery basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+// Package discovery 客户端服务发现，Resolver 负责提供动态变化的服务端地址列表，TransPool 根据地址列表维护一组 duplex.Trans 连接，
+// 地址增加时建立连接，地址删除时关闭连接。内置静态列表、DNS(SRV/A记录)、文件三种 Resolver，以及用于测试的 ManualResolver
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrResolverClosed Resolver 已经被关闭
+var ErrResolverClosed = errors.New("resolver closed")
+
+// Resolver 服务端地址解析器，地址格式为 host:port
+type Resolver interface {
+	// Watch 开始监听地址变化，每当地址列表变化时调用 onUpdate，返回前会同步的使用当前地址列表回调一次。
+	// 每个 Resolver 只能 Watch 一次
+	Watch(onUpdate func(endpoints []string)) error
+	// Close 停止监听
+	Close()
+}
+
+// NewStaticResolver 构建固定地址列表的 Resolver
+func NewStaticResolver(endpoints ...string) Resolver {
+	return &staticResolver{endpoints: endpoints}
+}
+
+type staticResolver struct {
+	endpoints []string
+}
+
+func (r *staticResolver) Watch(onUpdate func(endpoints []string)) error {
+	onUpdate(normalize(r.endpoints))
+	return nil
+}
+
+func (r *staticResolver) Close() {
+}
+
+// NewManualResolver 构建手动更新地址的 Resolver，一般用于测试，调用 Update 即可模拟地址变化
+func NewManualResolver(endpoints ...string) *ManualResolver {
+	return &ManualResolver{endpoints: normalize(endpoints)}
+}
+
+// ManualResolver 手动更新地址的 Resolver
+type ManualResolver struct {
+	lock      sync.Mutex
+	endpoints []string
+	onUpdate  func(endpoints []string)
+	closed    bool
+}
+
+func (r *ManualResolver) Watch(onUpdate func(endpoints []string)) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return ErrResolverClosed
+	}
+	r.onUpdate = onUpdate
+	onUpdate(r.endpoints)
+	return nil
+}
+
+// Update 更新地址列表，地址有变化时同步回调 Watch 设置的函数
+func (r *ManualResolver) Update(endpoints ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	endpoints = normalize(endpoints)
+	if r.closed || sameEndpoints(r.endpoints, endpoints) {
+		return
+	}
+	r.endpoints = endpoints
+	if r.onUpdate != nil {
+		r.onUpdate(endpoints)
+	}
+}
+
+func (r *ManualResolver) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+}
+
+// NewDnsResolver 构建基于DNS A/AAAA 记录的 Resolver，周期性的解析 host，每个ip与 port 组成一个地址
+//
+// interval 解析间隔
+func NewDnsResolver(host string, port int, interval time.Duration) Resolver {
+	return newPollingResolver(interval, "dns "+host, func() ([]string, error) {
+		ips, err := net.LookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+		var endpoints []string
+		for _, ip := range ips {
+			endpoints = append(endpoints, net.JoinHostPort(ip, strconv.Itoa(port)))
+		}
+		return endpoints, nil
+	})
+}
+
+// NewDnsSrvResolver 构建基于DNS SRV 记录的 Resolver，周期性的解析 _service._proto.name，每个记录的 target 与 port 组成一个地址
+//
+// interval 解析间隔
+func NewDnsSrvResolver(service string, proto string, name string, interval time.Duration) Resolver {
+	return newPollingResolver(interval, "dns srv "+name, func() ([]string, error) {
+		_, addrs, err := net.LookupSRV(service, proto, name)
+		if err != nil {
+			return nil, err
+		}
+		var endpoints []string
+		for _, addr := range addrs {
+			endpoints = append(endpoints, net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port))))
+		}
+		return endpoints, nil
+	})
+}
+
+// NewFileResolver 构建基于文件的 Resolver，文件中每行一个地址，空行和 # 开头的行被忽略，周期性的检查文件内容是否变化
+//
+// interval 检查间隔
+func NewFileResolver(path string, interval time.Duration) Resolver {
+	return newPollingResolver(interval, "file "+path, func() ([]string, error) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var endpoints []string
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			endpoints = append(endpoints, line)
+		}
+		return endpoints, scanner.Err()
+	})
+}
+
+// pollingResolver 周期性调用 lookup 获取地址列表，地址变化时回调。lookup 失败时保留上次的地址列表，并输出日志
+type pollingResolver struct {
+	interval time.Duration
+	name     string
+	lookup   func() ([]string, error)
+	closeCh  chan struct{}
+	once     sync.Once
+}
+
+func newPollingResolver(interval time.Duration, name string, lookup func() ([]string, error)) *pollingResolver {
+	return &pollingResolver{
+		interval: interval,
+		name:     name,
+		lookup:   lookup,
+		closeCh:  make(chan struct{}),
+	}
+}
+
+func (r *pollingResolver) Watch(onUpdate func(endpoints []string)) error {
+	endpoints, err := r.lookup()
+	if err != nil {
+		return err
+	}
+	current := normalize(endpoints)
+	onUpdate(current)
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.closeCh:
+				return
+			case <-ticker.C:
+				endpoints, err := r.lookup()
+				if err != nil {
+					nfour.NFourLogger.Info("resolver %s lookup error:%v\n", r.name, err)
+					continue
+				}
+				endpoints = normalize(endpoints)
+				if sameEndpoints(current, endpoints) {
+					continue
+				}
+				current = endpoints
+				onUpdate(current)
+			}
+		}
+	}()
+	return nil
+}
+
+func (r *pollingResolver) Close() {
+	r.once.Do(func() {
+		close(r.closeCh)
+	})
+}
+
+// normalize 去重并排序，便于比较
+func normalize(endpoints []string) []string {
+	set := make(map[string]struct{}, len(endpoints))
+	ret := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		if _, ok := set[e]; ok {
+			continue
+		}
+		set[e] = struct{}{}
+		ret = append(ret, e)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func sameEndpoints(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints")
+	if err := os.WriteFile(path, []byte("# servers\n127.0.0.1:9002\n\n127.0.0.1:9001\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := NewFileResolver(path, time.Millisecond*10)
+	defer r.Close()
+
+	updates := make(chan []string, 4)
+	if err := r.Watch(func(endpoints []string) {
+		updates <- endpoints
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-updates; !sameEndpoints(got, []string{"127.0.0.1:9001", "127.0.0.1:9002"}) {
+		t.Fatalf("unexpected endpoints %v", got)
+	}
+
+	if err := os.WriteFile(path, []byte("127.0.0.1:9003\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-updates:
+		if !sameEndpoints(got, []string{"127.0.0.1:9003"}) {
+			t.Fatalf("unexpected endpoints %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("file change not detected")
+	}
+}
+
+func TestManualResolverIgnoreSameEndpoints(t *testing.T) {
+	r := NewManualResolver("b:1", "a:1")
+	count := 0
+	r.Watch(func(endpoints []string) {
+		count++
+	})
+	r.Update("a:1", "b:1", "a:1")
+	r.Update("a:1")
+	if count != 2 {
+		t.Fatalf("expect 2 updates, got %d", count)
+	}
+}
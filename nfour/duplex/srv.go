@@ -6,14 +6,44 @@
 package duplex
 
 import (
+	"fmt"
 	"github.com/rolandhe/saber/nfour"
 	"github.com/rolandhe/saber/utils/bytutil"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
-const seqIdHeaderLength = 8
+const (
+	seqIdHeaderLength  = 8
+	statusHeaderLength = 1
+	fullHeaderLength   = nfour.PayLoadLenBufLength + seqIdHeaderLength + statusHeaderLength
+
+	// frameFlag header长度字段的最高位，标识携带状态码的13字节header。
+	// 不认识状态码的旧版本对端把长度解析为负数并关闭连接；读取到没有该标识的长度时返回 ErrProtocolMismatch 并关闭连接，
+	// 避免新旧版本之间按错误的header长度分帧
+	frameFlag = uint32(1) << 31
+)
+
+// ErrProtocolMismatch header中没有 frameFlag 标识，对端一般是使用12字节header的旧版本
+var ErrProtocolMismatch = fmt.Errorf("duplex protocol mismatch, peer may use old header without status, %w", nfour.ErrInvalidPayloadLength)
+
+// frameLength 校验header中的 frameFlag 并解析负载长度，长度超过 nfour.MaxPayloadLength 时返回 nfour.ErrInvalidPayloadLength
+func frameLength(header []byte) (int, error) {
+	v, err := bytutil.ToUint32(header[:nfour.PayLoadLenBufLength])
+	if err != nil {
+		return 0, err
+	}
+	if v&frameFlag == 0 {
+		return 0, ErrProtocolMismatch
+	}
+	l := int(v &^ frameFlag)
+	if l > nfour.MaxPayloadLength {
+		return 0, nfour.ErrInvalidPayloadLength
+	}
+	return l, nil
+}
 
 // Startup 启动一个多路复用的服务端，在多路复用模式下，每个连接由两个goroutine服务，一个负责读取请求，另一个负责写出响应，但一个读取goroutine可以持续的从连接中读取请求，
 // 而没有必要等待上一个请求完成，多个请求可以并发的被执行，最终这些结果被负责写的goroutine写出。
@@ -26,6 +56,12 @@ func Startup(port int, conf *nfour.SrvConf) {
 		return
 	}
 	nfour.NFourLogger.Info("listen tcp port %d,and next to accept\n", port)
+	Serve(ln, conf)
+}
+
+// Serve 使用已经创建的 net.Listener 提供多路复用服务，直到 Accept 失败(比如 ln 被关闭)才返回，
+// 可以用于包装过的listener，比如测试中注入网络故障
+func Serve(ln net.Listener, conf *nfour.SrvConf) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -37,127 +73,121 @@ func Startup(port int, conf *nfour.SrvConf) {
 	}
 }
 
+// ServeConn 使用多路复用模式服务一个已经建立的连接，立即返回，连接由内部的读写goroutine服务直到关闭。
+// 可以用于服务非tcp的连接，比如 net.Pipe
+func ServeConn(conn net.Conn, conf *nfour.SrvConf) {
+	handleConnection(conn, conf.GetConcurrent().TotalTokens(), conf)
+}
+
 func handleConnection(conn net.Conn, limitPerConn uint, conf *nfour.SrvConf) {
 	writeCh := make(chan *result, limitPerConn)
-	closeCh := make(chan struct{})
-	go readConn(conn, writeCh, closeCh, conf)
-	go writeConn(conn, writeCh, closeCh, conf)
+	go readConn(conn, writeCh, conf)
+	go writeConn(conn, writeCh, conf)
 }
 
-func readConn(conn net.Conn, writeCh chan *result, closeCh chan struct{}, conf *nfour.SrvConf) {
+// readConn 读取失败后关闭连接，并等待所有执行中的请求把结果交给writeCh后再关闭writeCh，
+// 避免执行中的请求向已经关闭的writeCh写入
+func readConn(conn net.Conn, writeCh chan *result, conf *nfour.SrvConf) {
 	nfour.NFourLogger.DebugLn("start to read header info...")
-	fullHeaderLength := seqIdHeaderLength + nfour.PayLoadLenBufLength
+	inFlight := &sync.WaitGroup{}
+	defer func() {
+		conn.Close()
+		go func() {
+			inFlight.Wait()
+			close(writeCh)
+		}()
+	}()
 	header := make([]byte, fullHeaderLength)
 	for {
 		conn.SetReadDeadline(time.Now().Add(conf.IdleTimeout))
 		err := nfour.InternalReadPayload(conn, header, fullHeaderLength, true)
 		if err != nil {
 			nfour.NFourLogger.InfoLn("read header error")
-			close(closeCh)
-			close(writeCh)
-			break
+			return
 		}
-		l, _ := bytutil.ToInt32(header[:nfour.PayLoadLenBufLength])
-		bodyBuff := make([]byte, l, l)
+		l, err := frameLength(header)
+		if err != nil {
+			nfour.NFourLogger.Info("%v, close connection from %s\n", err, conn.RemoteAddr())
+			return
+		}
+		bodyBuff := make([]byte, l)
 		conn.SetReadDeadline(time.Now().Add(conf.ReadTimeout))
-		err = nfour.InternalReadPayload(conn, bodyBuff, int(l), false)
+		err = nfour.InternalReadPayload(conn, bodyBuff, l, false)
 		if err != nil {
-			close(closeCh)
-			close(writeCh)
 			nfour.NFourLogger.Info("read payload error,need %d bytes\n", l)
-			break
+			return
 		}
 		seqId, _ := bytutil.ToUint64(header[nfour.PayLoadLenBufLength:])
+		if !conf.AdmitRate() {
+			writeCh <- &result{true, seqId, nfour.StatusOverloaded, []byte(nfour.ExceedRateLimitError.Error()), nil}
+			continue
+		}
 		if !conf.GetConcurrent().AcquireTimeout(conf.SemaWaitTime) {
-			writeCh <- &result{true, seqId, conf.ErrHandle(nfour.ExceedConcurrentError)}
+			writeCh <- &result{true, seqId, nfour.StatusOverloaded, []byte(nfour.ExceedConcurrentError.Error()), nil}
 			continue
 		}
-		go doBiz(bodyBuff, writeCh, conf, seqId)
+		inFlight.Add(1)
+		go doBiz(bodyBuff, writeCh, inFlight, conf, seqId)
 	}
 }
 
-func doBiz(bodyBuff []byte, writeCh chan *result, conf *nfour.SrvConf, seqId uint64) {
-	task := &nfour.Task{PayLoad: bodyBuff}
+func doBiz(bodyBuff []byte, writeCh chan *result, inFlight *sync.WaitGroup, conf *nfour.SrvConf, seqId uint64) {
+	defer inFlight.Done()
+	task := nfour.NewTask(bodyBuff, conf.GetConcurrent().Release)
 	resBody, err := conf.Working(task)
 
+	status := nfour.StatusOK
 	if err != nil {
-		resBody = conf.ErrHandle(err)
+		status = nfour.StatusOf(err)
+		resBody = []byte(nfour.StatusMessageOf(err))
 	}
-	writeCh <- &result{false, seqId, resBody}
+	writeCh <- &result{false, seqId, status, resBody, task}
 }
 
-// readConn 感知是否需要关闭连接后，通过closeCh来通知,writeConn得到消息后最终关闭连接
-// writeConn识别到网络失败，关闭连接后，等待readConn感知到后再通知writeConn是否资源
-func writeConn(conn net.Conn, writeCh chan *result, closeCh chan struct{}, conf *nfour.SrvConf) {
-	writeCloseConn := false
-	for {
-		if isClose(closeCh) {
-			if !writeCloseConn {
-				conn.Close()
-			}
-			return
+// writeConn 持续写出结果直到writeCh被readConn关闭，写出失败时关闭连接，readConn感知到后停止读取，
+// 之后的结果不再写出，但仍然需要释放信号量。被 nfour.Task.Hold 接管的信号量由业务处理结束时释放
+func writeConn(conn net.Conn, writeCh chan *result, conf *nfour.SrvConf) {
+	broken := false
+	for res := range writeCh {
+		if !broken && !writeCore(res.ret, res.seqId, res.status, conn, conf.WriteTimeout) {
+			broken = true
 		}
-		select {
-		case res := <-writeCh:
-			if !writeCore(res.ret, res.seqId, conn, conf.WriteTimeout) {
-				writeCloseConn = true
-				continue
-			}
-			// quickFailed=true代表没有执行也操作,直接返回超出并发错误,因此不需要释放信号量
-			if !res.quickFailed {
-				conf.GetConcurrent().Release()
-			}
-		case <-closeCh:
-			if !writeCloseConn {
-				conn.Close()
-			}
-			return
+		// quickFailed=true代表没有执行也操作,直接返回超出并发错误,因此不需要释放信号量
+		if !res.quickFailed {
+			res.task.Done()
 		}
 	}
 }
 
-func writeCore(res []byte, seqId uint64, conn net.Conn, timeout time.Duration) bool {
+func writeCore(res []byte, seqId uint64, status nfour.Status, conn net.Conn, timeout time.Duration) bool {
 	conn.SetWriteDeadline(time.Now().Add(timeout))
 
-	fullHeaderLength := nfour.PayLoadLenBufLength + seqIdHeaderLength
-
 	plen := len(res)
 	allSize := plen + fullHeaderLength
 	payload := make([]byte, allSize)
-	copy(payload, bytutil.Int32ToBytes(int32(plen)))
+	copy(payload, bytutil.Uint32ToBytes(uint32(plen)|frameFlag))
 	copy(payload[nfour.PayLoadLenBufLength:], bytutil.Uint64ToBytes(seqId))
+	payload[nfour.PayLoadLenBufLength+seqIdHeaderLength] = byte(status)
 	copy(payload[fullHeaderLength:], res)
 
-	l := 0
-	for {
+	for len(payload) > 0 {
 		n, err := conn.Write(payload)
 		if err != nil {
 			conn.Close()
 			nfour.NFourLogger.InfoLn(err, "write core failed")
 			return false
 		}
-		l += n
-		if l == allSize {
-			break
-		}
-		payload = payload[l:]
+		payload = payload[n:]
 	}
 
-	nfour.NFourLogger.Debug("write data:%d, expect:%d\n", l, allSize)
+	nfour.NFourLogger.Debug("write data:%d\n", allSize)
 	return true
 }
 
-func isClose(closeCh chan struct{}) bool {
-	select {
-	case <-closeCh:
-		return true
-	default:
-		return false
-	}
-}
-
 type result struct {
 	quickFailed bool
 	seqId       uint64
+	status      nfour.Status
 	ret         []byte
+	task        *nfour.Task
 }
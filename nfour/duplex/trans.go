@@ -4,7 +4,6 @@
 package duplex
 
 import (
-	"errors"
 	"github.com/rolandhe/saber/gocc"
 	"github.com/rolandhe/saber/nfour"
 	"github.com/rolandhe/saber/utils/bytutil"
@@ -15,10 +14,14 @@ import (
 )
 
 var (
-	// ErrTaskTimeout 请求执行超时异常
-	ErrTaskTimeout = errors.New("task execute timeout")
-	// ErrTransShutdown Trans 客户端已经被关闭
-	ErrTransShutdown = errors.New("transport shut down")
+	// ErrTaskTimeout 请求执行超时异常，同 nfour.ErrTaskTimeout
+	ErrTaskTimeout = nfour.ErrTaskTimeout
+	// ErrTaskCancelled 请求在收到响应前被调用方取消，同 nfour.ErrTaskCancelled
+	ErrTaskCancelled = nfour.ErrTaskCancelled
+	// ErrTransShutdown Trans 客户端已经被关闭，同 nfour.ErrTransShutdown
+	ErrTransShutdown = nfour.ErrTransShutdown
+	// ErrTransShutdownInFlight 请求等待响应时 Trans 被关闭，请求可能已经被发送到服务端，同 nfour.ErrTransShutdownInFlight
+	ErrTransShutdownInFlight = nfour.ErrTransShutdownInFlight
 )
 
 // TransConf Trans 客户端配置
@@ -30,18 +33,14 @@ type TransConf struct {
 
 	// IdleTimeout 连接长时间没有读取到数据的超时时间，该超过该时间，系统会输出日志，没有其他的处理，不会中断连接
 	IdleTimeout time.Duration
-	concurrent  gocc.Semaphore
+	// Breaker 熔断器，可选，设置后下游持续失败或者变慢时请求被快速失败，返回 nfour.ErrCircuitOpen。
+	// 每个 Trans 应该使用独立的熔断器
+	Breaker    *nfour.CircuitBreaker
+	concurrent gocc.Semaphore
 }
 
-// ReqTimeout 请求超时信息
-type ReqTimeout struct {
-	// ReadTimeout 网络读取超时时间
-	ReadTimeout time.Duration
-	// WriteTimeout 网络写出超时
-	WriteTimeout time.Duration
-	// WaitConcurrent 当到达最大并发时，等待执行的超时时间
-	WaitConcurrent time.Duration
-}
+// ReqTimeout 请求超时信息，同 nfour.ReqTimeout
+type ReqTimeout = nfour.ReqTimeout
 
 // NewTransConf 构建客户端的配置
 // rwTimeout 读写超时，这种情况下，读写超时是相同的
@@ -63,7 +62,12 @@ func NewTrans(addr string, conf *TransConf, name string) (*Trans, error) {
 		nfour.NFourLogger.InfoLn(err)
 		return nil, err
 	}
+	return NewTransWithConn(conn, conf, name), nil
+}
 
+// NewTransWithConn 使用已经建立的连接构建客户端 Trans，可以用于非tcp的连接，比如 net.Pipe
+// name 表示该 Trans的名称，该名称会被输出到日志中，方便发现问题
+func NewTransWithConn(conn net.Conn, conf *TransConf, name string) *Trans {
 	t := &Trans{
 		conn:     conn,
 		conf:     conf,
@@ -75,7 +79,7 @@ func NewTrans(addr string, conf *TransConf, name string) (*Trans, error) {
 	go asyncSender(t)
 	go asyncReader(t)
 
-	return t, nil
+	return t
 }
 
 // Trans 多路复用模式下的客户端，每个Trans内持有一个连接，并且与服务端类似，由两个goroutine分别负责请求的发出和响应的接收。
@@ -105,9 +109,37 @@ func (t *Trans) IsShutdown() bool {
 	return atomic.LoadInt32(&t.status) == 1
 }
 
+// IsAvailable Trans 是否可以接收新的请求，Trans 已经关闭或者熔断器处于打开状态时返回false
+func (t *Trans) IsAvailable() bool {
+	if t.IsShutdown() {
+		return false
+	}
+	return t.conf.Breaker == nil || t.conf.Breaker.State() != nfour.BreakerOpen
+}
+
+// BreakerState 获取熔断器状态，没有设置熔断器时总是返回 nfour.BreakerClosed
+func (t *Trans) BreakerState() nfour.BreakerState {
+	if t.conf.Breaker == nil {
+		return nfour.BreakerClosed
+	}
+	return t.conf.Breaker.State()
+}
+
 // SendPayload 发送二进制请求
 // reqTimeout 本次请求的超时时间
+//
+// 服务端返回非 nfour.StatusOK 的响应时，返回 *nfour.StatusError, 可以使用 errors.Is 与 nfour.ErrNotFound 等错误比较
+//
+// 设置了熔断器且熔断器打开时，直接返回 nfour.ErrCircuitOpen
 func (t *Trans) SendPayload(req []byte, reqTimeout *ReqTimeout) ([]byte, error) {
+	return t.SendPayloadCancel(req, reqTimeout, nil)
+}
+
+// SendPayloadCancel 与 SendPayload 相同，但可以在收到响应前通过关闭 cancel 来取消请求，取消后立即返回 ErrTaskCancelled。
+// 取消只是放弃等待响应并释放本地资源，已经发送的请求仍然会在服务端执行，其响应会被丢弃
+//
+// cancel 为nil时不能被取消
+func (t *Trans) SendPayloadCancel(req []byte, reqTimeout *ReqTimeout, cancel <-chan struct{}) ([]byte, error) {
 	if t.IsShutdown() {
 		return nil, ErrTransShutdown
 	}
@@ -117,6 +149,20 @@ func (t *Trans) SendPayload(req []byte, reqTimeout *ReqTimeout) ([]byte, error)
 	if !t.conf.concurrent.AcquireTimeout(reqTimeout.WaitConcurrent) {
 		return nil, nfour.ExceedConcurrentError
 	}
+	if t.conf.Breaker == nil {
+		return t.sendCore(req, reqTimeout, cancel)
+	}
+	ticket, err := t.conf.Breaker.Allow()
+	if err != nil {
+		t.conf.concurrent.Release()
+		return nil, err
+	}
+	res, err := t.sendCore(req, reqTimeout, cancel)
+	t.conf.Breaker.Done(ticket, err)
+	return res, err
+}
+
+func (t *Trans) sendCore(req []byte, reqTimeout *ReqTimeout, cancel <-chan struct{}) ([]byte, error) {
 	if reqTimeout.WriteTimeout <= 0 {
 		reqTimeout.WriteTimeout = t.conf.WriteTimeout
 	}
@@ -132,13 +178,31 @@ func (t *Trans) SendPayload(req []byte, reqTimeout *ReqTimeout) ([]byte, error)
 		notifier: make(chan struct{}),
 	}
 	t.cache.Store(seqId, fu)
-	t.sendCh <- &sendingTask{
+	task := &sendingTask{
 		seqId:   seqId,
 		payload: req,
 		timeout: reqTimeout.WriteTimeout,
 		f:       fu,
 	}
-	return fu.get(reqTimeout.ReadTimeout)
+	// asyncSender 退出后不再消费sendCh，避免阻塞
+	select {
+	case t.sendCh <- task:
+	case <-t.shutDown:
+		t.abandon(seqId)
+		return nil, ErrTransShutdown
+	}
+	res, err := fu.get(reqTimeout.ReadTimeout, cancel)
+	if err == ErrTaskTimeout || err == ErrTaskCancelled {
+		t.abandon(seqId)
+	}
+	return res, err
+}
+
+// abandon 放弃等待seqId对应的响应，与 asyncReader 竞争删除future，删除成功的一方负责释放并发信号量
+func (t *Trans) abandon(seqId uint64) {
+	if _, ok := t.cache.LoadAndDelete(seqId); ok {
+		t.conf.concurrent.Release()
+	}
 }
 
 // asyncSender/asyncReader以及外部都可以调用Shutdown发送关闭指令
@@ -151,7 +215,7 @@ func asyncSender(trans *Trans) {
 		defer timer.Stop()
 		select {
 		case task := <-trans.sendCh:
-			if !writeCore(task.payload, task.seqId, trans.conn, task.timeout) {
+			if !writeCore(task.payload, task.seqId, nfour.StatusOK, trans.conn, task.timeout) {
 				nfour.NFourLogger.Info("%s write err,will shutdown\n", trans.name)
 				trans.Shutdown("sender")
 				releaseWait = true
@@ -190,7 +254,6 @@ func asyncSender(trans *Trans) {
 }
 
 func asyncReader(trans *Trans) {
-	fullHeaderLength := nfour.PayLoadLenBufLength + seqIdHeaderLength
 	header := make([]byte, fullHeaderLength)
 	for {
 		if trans.IsShutdown() {
@@ -202,27 +265,35 @@ func asyncReader(trans *Trans) {
 			trans.Shutdown("reader")
 			break
 		}
-		l, _ := bytutil.ToInt32(header[:nfour.PayLoadLenBufLength])
-		bodyBuff := make([]byte, l, l)
-		seqId, err := bytutil.ToUint64(header[nfour.PayLoadLenBufLength:])
-		trans.conn.SetReadDeadline(time.Now().Add(trans.conf.ReadTimeout))
-		err = nfour.InternalReadPayload(trans.conn, bodyBuff, int(l), false)
+		l, err := frameLength(header)
 		if err != nil {
-			nfour.NFourLogger.Info("%s read payload error:%v,need %d bytes\n", trans.name, err, l)
+			nfour.NFourLogger.Info("%s read header error:%v\n", trans.name, err)
 			trans.Shutdown("reader")
 			break
 		}
-		f, ok := trans.cache.Load(seqId)
-		if !ok {
-			nfour.NFourLogger.Info("warning: %s lost seqId:%d with read result\n", trans.name, seqId)
-			continue
+		bodyBuff := make([]byte, l)
+		seqId, _ := bytutil.ToUint64(header[nfour.PayLoadLenBufLength:])
+		status := nfour.Status(header[nfour.PayLoadLenBufLength+seqIdHeaderLength])
+		trans.conn.SetReadDeadline(time.Now().Add(trans.conf.ReadTimeout))
+		if err = nfour.InternalReadPayload(trans.conn, bodyBuff, l, false); err != nil {
+			nfour.NFourLogger.Info("%s read payload error:%v,need %d bytes\n", trans.name, err, l)
+			trans.Shutdown("reader")
+			break
 		}
 		if trans.IsShutdown() {
 			break
 		}
-		trans.cache.Delete(seqId)
+		f, ok := trans.cache.LoadAndDelete(seqId)
+		if !ok {
+			nfour.NFourLogger.Info("warning: %s lost seqId:%d with read result, it may be timeout or cancelled\n", trans.name, seqId)
+			continue
+		}
 		fu := f.(*future)
-		fu.accept(bodyBuff, err)
+		if status != nfour.StatusOK {
+			fu.accept(nil, nfour.NewStatusError(status, string(bodyBuff)))
+		} else {
+			fu.accept(bodyBuff, nil)
+		}
 		trans.conf.concurrent.Release()
 	}
 	nfour.NFourLogger.Info("%s async reader release futures\n", trans.name)
@@ -230,7 +301,7 @@ func asyncReader(trans *Trans) {
 
 	trans.cache.Range(func(key, value any) bool {
 		fu := value.(*future)
-		fu.accept(nil, ErrTransShutdown)
+		fu.accept(nil, ErrTransShutdownInFlight)
 		releasedCount++
 		return true
 	})
@@ -252,7 +323,7 @@ type future struct {
 	flag     atomic.Bool
 }
 
-func (f *future) get(timeout time.Duration) ([]byte, error) {
+func (f *future) get(timeout time.Duration, cancel <-chan struct{}) ([]byte, error) {
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 	select {
@@ -260,6 +331,8 @@ func (f *future) get(timeout time.Duration) ([]byte, error) {
 		return f.value, f.err
 	case <-timer.C:
 		return nil, ErrTaskTimeout
+	case <-cancel:
+		return nil, ErrTaskCancelled
 	}
 }
 
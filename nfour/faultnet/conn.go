@@ -0,0 +1,163 @@
+// fault injection basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+// Package faultnet 可以注入网络故障的 net.Conn 和 net.Listener 包装，用于测试 nfour 在网络异常情况下的行为。
+// 支持注入读写延迟、部分读取(short read)、部分写出(short write)、连接重置以及损坏数据流中指定位置的字节(比如header)。
+//
+// 服务端使用 Listen 包装 listener，再交给 duplex.Serve 或者 simplex.Serve；客户端使用 Wrap 包装连接后交给 duplex.NewTransWithConn，
+// 或者把 Dialer 设置到 simplex.ClientConf.Dialer
+package faultnet
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrReset 连接已经被注入的故障重置
+var ErrReset = errors.New("connection reset by fault injection")
+
+// Faults 需要注入的故障，零值表示不注入任何故障。Faults 只描述故障，读写计数保存在每个连接中，因此可以被多个连接共享
+type Faults struct {
+	// ReadDelay 每次Read前的延迟，用于模拟慢速的对端
+	ReadDelay time.Duration
+	// WriteDelay 每次Write前的延迟
+	WriteDelay time.Duration
+	// MaxReadChunk 每次Read最多返回的字节数，大于0时模拟部分读取
+	MaxReadChunk int
+	// MaxWriteChunk 每次Write最多写出的字节数，大于0时模拟部分写出，Write返回的n小于数据长度且err为nil
+	MaxWriteChunk int
+	// ResetAfterRead 累计读取到该字节数后重置连接，大于0时生效，可以用来模拟在帧中间断开连接
+	ResetAfterRead int64
+	// ResetAfterWrite 累计写出该字节数后重置连接，大于0时生效
+	ResetAfterWrite int64
+	// CorruptReadAt 读取的数据流中需要被损坏的字节偏移量，对应的字节会被按位取反
+	CorruptReadAt []int64
+	// CorruptWriteAt 写出的数据流中需要被损坏的字节偏移量，比如 0 表示损坏第一个帧header中的长度
+	CorruptWriteAt []int64
+}
+
+// Wrap 包装连接，按照 faults 注入故障，faults 为nil时不注入故障
+func Wrap(conn net.Conn, faults *Faults) *Conn {
+	if faults == nil {
+		faults = &Faults{}
+	}
+	return &Conn{Conn: conn, faults: faults}
+}
+
+// Dialer 返回建立tcp连接并注入故障的函数，可以直接设置到 simplex.ClientConf.Dialer
+func Dialer(faults *Faults) func(addr string, timeout time.Duration) (net.Conn, error) {
+	return func(addr string, timeout time.Duration) (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return Wrap(conn, faults), nil
+	}
+}
+
+// Listen 包装 listener，每个被接受的连接都按照 faults 注入故障
+func Listen(ln net.Listener, faults *Faults) net.Listener {
+	return &listener{ln, faults}
+}
+
+type listener struct {
+	net.Listener
+	faults *Faults
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(conn, l.faults), nil
+}
+
+// Conn 注入故障的连接
+type Conn struct {
+	net.Conn
+	faults   *Faults
+	readN    atomic.Int64
+	writeN   atomic.Int64
+	resetted atomic.Bool
+}
+
+// Read 按照 Faults 延迟、截断或者损坏读取到的数据，达到 ResetAfterRead 后重置连接
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.resetted.Load() {
+		return 0, ErrReset
+	}
+	if c.faults.ReadDelay > 0 {
+		time.Sleep(c.faults.ReadDelay)
+	}
+	b = limit(b, c.faults.MaxReadChunk, c.faults.ResetAfterRead, c.readN.Load())
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		offset := c.readN.Add(int64(n)) - int64(n)
+		corrupt(b[:n], offset, c.faults.CorruptReadAt)
+		if c.faults.ResetAfterRead > 0 && offset+int64(n) >= c.faults.ResetAfterRead {
+			c.Reset()
+		}
+	}
+	return n, err
+}
+
+// Write 按照 Faults 延迟、部分写出或者损坏写出的数据，达到 ResetAfterWrite 后重置连接
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.resetted.Load() {
+		return 0, ErrReset
+	}
+	if c.faults.WriteDelay > 0 {
+		time.Sleep(c.faults.WriteDelay)
+	}
+	b = limit(b, c.faults.MaxWriteChunk, c.faults.ResetAfterWrite, c.writeN.Load())
+	offset := c.writeN.Load()
+	if len(c.faults.CorruptWriteAt) > 0 {
+		// 不能修改调用方的数据
+		copied := make([]byte, len(b))
+		copy(copied, b)
+		corrupt(copied, offset, c.faults.CorruptWriteAt)
+		b = copied
+	}
+	n, err := c.Conn.Write(b)
+	c.writeN.Add(int64(n))
+	if c.faults.ResetAfterWrite > 0 && offset+int64(n) >= c.faults.ResetAfterWrite {
+		c.Reset()
+	}
+	return n, err
+}
+
+// Reset 立即重置连接，tcp连接会发送RST，之后的读写都返回 ErrReset
+func (c *Conn) Reset() {
+	if !c.resetted.CompareAndSwap(false, true) {
+		return
+	}
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	c.Conn.Close()
+}
+
+// limit 根据单次读写上限以及重置前剩余的字节数截断b
+func limit(b []byte, maxChunk int, resetAfter int64, done int64) []byte {
+	if maxChunk > 0 && len(b) > maxChunk {
+		b = b[:maxChunk]
+	}
+	if resetAfter > 0 {
+		remain := resetAfter - done
+		if remain < int64(len(b)) {
+			b = b[:remain]
+		}
+	}
+	return b
+}
+
+func corrupt(b []byte, offset int64, positions []int64) {
+	for _, pos := range positions {
+		if pos >= offset && pos < offset+int64(len(b)) {
+			b[pos-offset] = ^b[pos-offset]
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package faultnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"github.com/rolandhe/saber/nfour/simplex"
+	"github.com/rolandhe/saber/utils/bytutil"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func echoWorking(task *nfour.Task) ([]byte, error) {
+	return task.PayLoad, nil
+}
+
+func errHandle(err error) []byte {
+	return []byte(err.Error())
+}
+
+func listen(t *testing.T, faults *Faults) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+	})
+	return Listen(ln, faults)
+}
+
+func startDuplex(t *testing.T, conf *nfour.SrvConf, faults *Faults) string {
+	ln := listen(t, faults)
+	go duplex.Serve(ln, conf)
+	return ln.Addr().String()
+}
+
+func dialTrans(t *testing.T, addr string, faults *Faults) *duplex.Trans {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans := duplex.NewTransWithConn(Wrap(conn, faults), duplex.NewTransConf(time.Second*2, 10), "fault")
+	t.Cleanup(func() {
+		trans.Shutdown("test")
+	})
+	return trans
+}
+
+func payload(i int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%04d", i)), 1024)
+}
+
+func TestDuplexShortReadsAndWrites(t *testing.T) {
+	faults := &Faults{MaxReadChunk: 7, MaxWriteChunk: 3}
+	addr := startDuplex(t, nfour.NewSrvConf(echoWorking, errHandle, 10), faults)
+	trans := dialTrans(t, addr, faults)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := trans.SendPayload(payload(i), nil)
+			if err != nil {
+				t.Errorf("request %d failed: %v", i, err)
+				return
+			}
+			if !bytes.Equal(res, payload(i)) {
+				t.Errorf("request %d got corrupted response", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestDuplexSlowPeer(t *testing.T) {
+	addr := startDuplex(t, nfour.NewSrvConf(echoWorking, errHandle, 10), &Faults{WriteDelay: time.Millisecond * 200})
+	trans := dialTrans(t, addr, nil)
+	_, err := trans.SendPayload([]byte("slow"), &duplex.ReqTimeout{ReadTimeout: time.Millisecond * 50})
+	if !errors.Is(err, nfour.ErrTaskTimeout) {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	if res, err := trans.SendPayload([]byte("slow"), nil); err != nil || string(res) != "slow" {
+		t.Fatalf("unexpected result %s %v", res, err)
+	}
+}
+
+// 服务端写出响应到一半时连接被重置，客户端收到关闭错误，服务端不能泄漏并发信号量
+func TestDuplexMidFrameReset(t *testing.T) {
+	conf := nfour.NewSrvConf(echoWorking, errHandle, 1)
+	addr := startDuplex(t, conf, &Faults{ResetAfterWrite: 20})
+	trans := dialTrans(t, addr, nil)
+	if _, err := trans.SendPayload(payload(1), nil); !errors.Is(err, nfour.ErrTransShutdown) {
+		t.Fatalf("expect shutdown, got %v", err)
+	}
+
+	healthy := dialTrans(t, startDuplex(t, conf, nil), nil)
+	deadline := time.Now().Add(time.Second)
+	for {
+		res, err := healthy.SendPayload([]byte("hi"), nil)
+		if err == nil && string(res) == "hi" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server did not recover: %v", err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// 客户端写出的header长度被损坏，服务端关闭连接而不是按照错误的长度分配内存
+func TestDuplexCorruptedHeader(t *testing.T) {
+	addr := startDuplex(t, nfour.NewSrvConf(echoWorking, errHandle, 10), nil)
+	trans := dialTrans(t, addr, &Faults{CorruptWriteAt: []int64{3}})
+	if _, err := trans.SendPayload([]byte("hi"), nil); !errors.Is(err, nfour.ErrTransShutdown) {
+		t.Fatalf("expect shutdown, got %v", err)
+	}
+	if _, err := trans.SendPayload([]byte("hi"), nil); !errors.Is(err, nfour.ErrTransShutdown) {
+		t.Fatalf("expect shutdown, got %v", err)
+	}
+}
+
+// 旧版本的12字节header没有版本标识，服务端关闭连接而不是错误分帧
+func TestDuplexOldHeader(t *testing.T) {
+	addr := startDuplex(t, nfour.NewSrvConf(echoWorking, errHandle, 10), nil)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	frame := append(bytutil.Int32ToBytes(2), bytutil.Uint64ToBytes(1)...)
+	conn.Write(append(frame, "hi"...))
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if n, err := conn.Read(make([]byte, 16)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect connection closed, got %d bytes, %v", n, err)
+	}
+
+	// 旧版本的服务端返回12字节header的响应，客户端关闭 Trans
+	ln := listen(t, nil)
+	go func() {
+		srvConn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer srvConn.Close()
+		io.ReadFull(srvConn, make([]byte, 13+2))
+		srvConn.Write(append(frame, "hi"...))
+		io.ReadAll(srvConn)
+	}()
+	trans := dialTrans(t, ln.Addr().String(), nil)
+	if _, err = trans.SendPayload([]byte("hi"), nil); !errors.Is(err, nfour.ErrTransShutdown) {
+		t.Fatalf("expect shutdown, got %v", err)
+	}
+}
+
+func TestTransReadReset(t *testing.T) {
+	addr := startDuplex(t, nfour.NewSrvConf(echoWorking, errHandle, 10), nil)
+	trans := dialTrans(t, addr, &Faults{ResetAfterRead: 5})
+	if _, err := trans.SendPayload([]byte("hi"), nil); !errors.Is(err, nfour.ErrTransShutdownInFlight) {
+		t.Fatalf("expect shutdown in flight, got %v", err)
+	}
+	if trans.IsAvailable() {
+		t.Fatal("trans should not be available after reset")
+	}
+}
+
+func startSimplex(t *testing.T, faults *Faults) string {
+	ln := listen(t, faults)
+	go simplex.Serve(ln, nfour.NewSrvConf(echoWorking, errHandle, 10))
+	return ln.Addr().String()
+}
+
+func newSimplexClient(t *testing.T, addr string, faults *Faults) *simplex.Client {
+	conf := simplex.NewClientConf(time.Second*2, 4)
+	conf.Dialer = Dialer(faults)
+	client, err := simplex.NewClient(addr, conf, "fault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Shutdown("test")
+	})
+	return client
+}
+
+func TestSimplexShortReadsAndWrites(t *testing.T) {
+	faults := &Faults{MaxReadChunk: 5, MaxWriteChunk: 3}
+	client := newSimplexClient(t, startSimplex(t, faults), faults)
+	for i := 0; i < 4; i++ {
+		res, err := client.SendPayload(payload(i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res, payload(i)) {
+			t.Fatalf("request %d got corrupted response", i)
+		}
+	}
+}
+
+func TestSimplexMidFrameReset(t *testing.T) {
+	client := newSimplexClient(t, startSimplex(t, &Faults{ResetAfterWrite: 10}), nil)
+	if _, err := client.SendPayload(payload(1), nil); err == nil {
+		t.Fatal("expect error when response is cut")
+	}
+}
+
+func TestSimplexCorruptedHeader(t *testing.T) {
+	client := newSimplexClient(t, startSimplex(t, nil), &Faults{CorruptWriteAt: []int64{3}})
+	if _, err := client.SendPayload([]byte("hi"), nil); err == nil {
+		t.Fatal("expect error when header is corrupted")
+	}
+}
+
+func TestSimplexSlowPeer(t *testing.T) {
+	client := newSimplexClient(t, startSimplex(t, &Faults{WriteDelay: time.Millisecond * 200}), nil)
+	_, err := client.SendPayload([]byte("slow"), &nfour.ReqTimeout{ReadTimeout: time.Millisecond * 50})
+	if !errors.Is(err, nfour.ErrTaskTimeout) {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+}
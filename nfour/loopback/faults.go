@@ -0,0 +1,101 @@
+// in-process transport basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package loopback
+
+import (
+	"github.com/rolandhe/saber/nfour"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Faults 描述需要注入的故障，用于测试服务和客户端在延迟、丢包、错误情况下的行为
+type Faults struct {
+	// Latency 每个请求注入的延迟，nil表示不注入延迟
+	Latency func() time.Duration
+	// DropRate 请求被丢弃的概率，0-1之间，被丢弃的请求不会被处理，调用方等待 ReadTimeout 后收到 nfour.ErrTaskTimeout，
+	// 没有设置 ReadTimeout 时立即返回 nfour.ErrTaskTimeout
+	DropRate float64
+	// ErrorRate 请求返回 Err 的概率，0-1之间，返回错误的请求不会被处理
+	ErrorRate float64
+	// Err 注入的错误，nil表示使用 nfour.StatusInternal 状态的错误
+	Err error
+	// Seed 随机数种子，相同的种子和请求顺序得到相同的注入结果，保证测试可以重复
+	Seed int64
+}
+
+// FixedLatency 固定的延迟，可以设置到 Faults.Latency
+func FixedLatency(d time.Duration) func() time.Duration {
+	return func() time.Duration {
+		return d
+	}
+}
+
+type faultAction int
+
+const (
+	faultNone faultAction = iota
+	faultDrop
+	faultError
+)
+
+// injector 根据 Faults 为每个请求决定注入的故障，随机数生成器由锁保护，保证并发下结果序列仍然由种子决定
+type injector struct {
+	faults *Faults
+	lock   sync.Mutex
+	rnd    *rand.Rand
+}
+
+func newInjector(faults *Faults) *injector {
+	if faults == nil {
+		return nil
+	}
+	return &injector{
+		faults: faults,
+		rnd:    rand.New(rand.NewSource(faults.Seed)),
+	}
+}
+
+func (in *injector) next() (faultAction, time.Duration) {
+	if in == nil {
+		return faultNone, 0
+	}
+	var latency time.Duration
+	if in.faults.Latency != nil {
+		latency = in.faults.Latency()
+	}
+	in.lock.Lock()
+	v := in.rnd.Float64()
+	in.lock.Unlock()
+	switch {
+	case v < in.faults.DropRate:
+		return faultDrop, latency
+	case v < in.faults.DropRate+in.faults.ErrorRate:
+		return faultError, latency
+	}
+	return faultNone, latency
+}
+
+func (in *injector) err() error {
+	if in.faults.Err != nil {
+		return in.faults.Err
+	}
+	return nfour.NewStatusError(nfour.StatusInternal, "injected fault")
+}
+
+// WrapWorking 为 WorkingFunc 注入延迟和错误，可以用于 NewPipeTrans 或者真实的服务端。
+// 服务端的处理函数必须返回，因此 Faults.DropRate 在这里不生效，需要模拟丢包时使用 NewTransWithFaults
+func WrapWorking(working nfour.WorkingFunc, faults *Faults) nfour.WorkingFunc {
+	in := newInjector(faults)
+	return func(task *nfour.Task) ([]byte, error) {
+		action, latency := in.next()
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		if action == faultError {
+			return nil, in.err()
+		}
+		return working(task)
+	}
+}
@@ -0,0 +1,92 @@
+package loopback
+
+import (
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"testing"
+	"time"
+)
+
+func echoWorking(task *nfour.Task) ([]byte, error) {
+	if string(task.PayLoad) == "missing" {
+		return nil, nfour.NewStatusError(nfour.StatusNotFound, "missing")
+	}
+	return append([]byte("echo:"), task.PayLoad...), nil
+}
+
+func TestLoopbackStatusError(t *testing.T) {
+	trans := NewTrans(echoWorking, "test")
+	res, err := trans.SendPayload([]byte("hi"), nil)
+	if err != nil || string(res) != "echo:hi" {
+		t.Fatalf("unexpected result %s %v", res, err)
+	}
+	if _, err = trans.SendPayload([]byte("missing"), nil); !errors.Is(err, nfour.ErrNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+	trans.Shutdown("test")
+	if _, err = trans.SendPayload([]byte("hi"), nil); !errors.Is(err, nfour.ErrTransShutdown) {
+		t.Fatalf("expect shutdown, got %v", err)
+	}
+}
+
+func TestLoopbackFaultsAreDeterministic(t *testing.T) {
+	run := func() []bool {
+		trans := NewTransWithFaults(echoWorking, &Faults{DropRate: 0.2, ErrorRate: 0.3, Seed: 42}, "test")
+		var outcomes []bool
+		for i := 0; i < 50; i++ {
+			_, err := trans.SendPayload([]byte("hi"), nil)
+			outcomes = append(outcomes, err == nil)
+		}
+		return outcomes
+	}
+	first := run()
+	second := run()
+	failed := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("outcome %d differs between runs with the same seed", i)
+		}
+		if !first[i] {
+			failed++
+		}
+	}
+	if failed == 0 || failed == len(first) {
+		t.Fatalf("unexpected failure count %d", failed)
+	}
+}
+
+func TestLoopbackLatencyAndTimeout(t *testing.T) {
+	trans := NewTransWithFaults(echoWorking, &Faults{Latency: FixedLatency(time.Millisecond * 50)}, "test")
+	_, err := trans.SendPayload([]byte("hi"), &nfour.ReqTimeout{ReadTimeout: time.Millisecond * 10})
+	if !errors.Is(err, nfour.ErrTaskTimeout) {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	start := time.Now()
+	if _, err = trans.SendPayload([]byte("hi"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < time.Millisecond*50 {
+		t.Fatalf("latency is not injected")
+	}
+}
+
+func TestPipeTrans(t *testing.T) {
+	srvConf := nfour.NewSrvConf(WrapWorking(echoWorking, &Faults{ErrorRate: 1}), nil, 10)
+	trans := NewPipeTrans(srvConf, duplex.NewTransConf(time.Second, 10), "pipe")
+	defer trans.Shutdown("test")
+	if _, err := trans.SendPayload([]byte("hi"), nil); !errors.Is(err, nfour.ErrInternal) {
+		t.Fatalf("expect injected internal error, got %v", err)
+	}
+
+	srvConf = nfour.NewSrvConf(echoWorking, nil, 10)
+	trans2 := NewPipeTrans(srvConf, duplex.NewTransConf(time.Second, 10), "pipe")
+	defer trans2.Shutdown("test")
+	res, err := trans2.SendPayload([]byte("hi"), nil)
+	if err != nil || string(res) != "echo:hi" {
+		t.Fatalf("unexpected result %s %v", res, err)
+	}
+	if _, err = trans2.SendPayload([]byte("missing"), nil); !errors.Is(err, nfour.ErrNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+// in-process transport basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+// Package loopback 进程内的传输实现，请求不经过网络，直接交给 nfour.WorkingFunc 处理，错误按照多路复用模式的规则转换成 *nfour.StatusError，
+// 与真实的 duplex.Trans 行为一致。主要用于rpc服务和客户端的单元测试，不需要启动tcp服务。
+//
+// 支持注入延迟、丢包和错误(见 Faults)，注入结果由随机数种子决定，测试可以重复；也可以通过 NewPipeTrans 使用 net.Pipe 运行完整的多路复用协议
+package loopback
+
+import (
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// NewTrans 构建进程内传输
+//
+// working 请求处理函数，一般由 rpc.NewRpcWorking 或者 proto.NewJsonRpcSrvWorking 构建
+//
+// name 表示该 Trans的名称，该名称会被输出到日志中，方便发现问题
+func NewTrans(working nfour.WorkingFunc, name string) *Trans {
+	return NewTransWithFaults(working, nil, name)
+}
+
+// NewTransWithFaults 构建注入故障的进程内传输，faults 为nil时不注入故障
+func NewTransWithFaults(working nfour.WorkingFunc, faults *Faults, name string) *Trans {
+	return &Trans{
+		working:  working,
+		injector: newInjector(faults),
+		name:     name,
+	}
+}
+
+// NewPipeTrans 使用 net.Pipe 连接 duplex.Trans 与多路复用服务端，请求经过完整的多路复用编解码，但不需要监听端口。
+// 需要注入延迟和错误时可以使用 WrapWorking 包装 srvConf.Working
+func NewPipeTrans(srvConf *nfour.SrvConf, transConf *duplex.TransConf, name string) *duplex.Trans {
+	srvConn, cliConn := net.Pipe()
+	duplex.ServeConn(srvConn, srvConf)
+	return duplex.NewTransWithConn(cliConn, transConf, name)
+}
+
+// Trans 进程内传输，实现了 rpc.Transport
+type Trans struct {
+	working  nfour.WorkingFunc
+	injector *injector
+	status   int32
+	name     string
+}
+
+// Shutdown 关闭Trans
+func (t *Trans) Shutdown(source string) {
+	if atomic.CompareAndSwapInt32(&t.status, 0, 1) {
+		nfour.NFourLogger.Info("%s trigger %s shutdown\n", source, t.name)
+	}
+}
+
+// IsShutdown Trans是否已经被关闭
+func (t *Trans) IsShutdown() bool {
+	return atomic.LoadInt32(&t.status) == 1
+}
+
+// IsAvailable Trans是否可以接收新的请求
+func (t *Trans) IsAvailable() bool {
+	return !t.IsShutdown()
+}
+
+// SendPayload 把请求交给 WorkingFunc 处理并返回结果
+//
+// reqTimeout 只有 ReadTimeout 生效，大于0时超时返回 nfour.ErrTaskTimeout
+func (t *Trans) SendPayload(req []byte, reqTimeout *nfour.ReqTimeout) ([]byte, error) {
+	return t.SendPayloadCancel(req, reqTimeout, nil)
+}
+
+// SendPayloadCancel 与 SendPayload 相同，但可以通过关闭 cancel 来放弃等待，返回 nfour.ErrTaskCancelled
+func (t *Trans) SendPayloadCancel(req []byte, reqTimeout *nfour.ReqTimeout, cancel <-chan struct{}) ([]byte, error) {
+	if t.IsShutdown() {
+		return nil, nfour.ErrTransShutdown
+	}
+	// 拷贝请求，避免处理函数与调用方共享内存，与网络传输的语义保持一致
+	payload := make([]byte, len(req))
+	copy(payload, req)
+
+	var timeoutCh <-chan time.Time
+	if reqTimeout != nil && reqTimeout.ReadTimeout > 0 {
+		timer := time.NewTimer(reqTimeout.ReadTimeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	action, latency := t.injector.next()
+	if action == faultDrop && timeoutCh == nil {
+		return nil, nfour.ErrTaskTimeout
+	}
+	resultCh := make(chan *result, 1)
+	go func() {
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		switch action {
+		case faultDrop:
+			return
+		case faultError:
+			resultCh <- &result{nil, t.injector.err()}
+		default:
+			res, err := t.working(&nfour.Task{PayLoad: payload})
+			resultCh <- &result{res, err}
+		}
+	}()
+
+	select {
+	case r := <-resultCh:
+		return r.convert()
+	case <-timeoutCh:
+		return nil, nfour.ErrTaskTimeout
+	case <-cancel:
+		return nil, nfour.ErrTaskCancelled
+	}
+}
+
+type result struct {
+	res []byte
+	err error
+}
+
+// convert 与多路复用模式相同，处理函数返回的err被转换成帧状态码和错误信息
+func (r *result) convert() ([]byte, error) {
+	if r.err != nil {
+		return nil, nfour.NewStatusError(nfour.StatusOf(r.err), nfour.StatusMessageOf(r.err))
+	}
+	return r.res, nil
+}
@@ -0,0 +1,112 @@
+// rpc abstraction basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package rpc
+
+import (
+	"bytes"
+	"container/list"
+	"github.com/rolandhe/saber/hash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheConf 响应缓存的设置
+type CacheConf struct {
+	// TTL 缓存的有效期，必须大于0
+	TTL time.Duration
+	// MaxEntries 最多缓存的响应数，0表示不限制
+	MaxEntries int
+	// MaxBytes 缓存的请求和响应数据的最大字节数，0表示不限制
+	MaxBytes int
+}
+
+// WithCache 为方法开启响应缓存，只适用于结果只与请求数据相关的幂等方法，比如查询。
+// 缓存以请求数据的 hash.CityHash64 为key，缓存编码后的响应，业务处理函数返回错误时不缓存；超过 MaxEntries 或者 MaxBytes 时淘汰最久未使用的响应。
+// 命中缓存的请求不会执行业务处理函数，也不受并发上限和超时时间的约束
+func WithCache(conf CacheConf) RouteOption {
+	return func(opts *routeOptions) {
+		if conf.TTL > 0 {
+			opts.cache = newRespCache(conf)
+		}
+	}
+}
+
+type cacheEntry struct {
+	hash    uint64
+	payload []byte
+	res     []byte
+	expire  time.Time
+}
+
+func (e *cacheEntry) size() int {
+	return len(e.payload) + len(e.res)
+}
+
+// respCache 基于 LRU 淘汰的响应缓存，链表头部是最近使用的响应
+type respCache struct {
+	conf    CacheConf
+	lock    sync.Mutex
+	lru     *list.List
+	entries map[uint64]*list.Element
+	bytes   int
+	hits    atomic.Int64
+	misses  atomic.Int64
+}
+
+func newRespCache(conf CacheConf) *respCache {
+	return &respCache{
+		conf:    conf,
+		lru:     list.New(),
+		entries: map[uint64]*list.Element{},
+	}
+}
+
+// get 请求数据的hash值相同时还需要比较请求数据，避免hash冲突返回错误的响应
+func (c *respCache) get(payload []byte) ([]byte, bool) {
+	h := hash.CityHash64(payload, uint(len(payload)))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[h]; ok {
+		entry := el.Value.(*cacheEntry)
+		if time.Now().Before(entry.expire) && bytes.Equal(entry.payload, payload) {
+			c.lru.MoveToFront(el)
+			c.hits.Add(1)
+			return entry.res, true
+		}
+		if !time.Now().Before(entry.expire) {
+			c.remove(el)
+		}
+	}
+	c.misses.Add(1)
+	return nil, false
+}
+
+func (c *respCache) put(payload []byte, res []byte) {
+	entry := &cacheEntry{
+		hash:    hash.CityHash64(payload, uint(len(payload))),
+		payload: append([]byte(nil), payload...),
+		res:     res,
+		expire:  time.Now().Add(c.conf.TTL),
+	}
+	if c.conf.MaxBytes > 0 && entry.size() > c.conf.MaxBytes {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[entry.hash]; ok {
+		c.remove(el)
+	}
+	c.entries[entry.hash] = c.lru.PushFront(entry)
+	c.bytes += entry.size()
+	for (c.conf.MaxEntries > 0 && c.lru.Len() > c.conf.MaxEntries) || (c.conf.MaxBytes > 0 && c.bytes > c.conf.MaxBytes) {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *respCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.hash)
+	c.bytes -= entry.size()
+}
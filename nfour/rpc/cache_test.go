@@ -0,0 +1,56 @@
+package rpc
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRouteCache(t *testing.T) {
+	working, router := newStringRouter()
+	calls := 0
+	router.Register("lookup", func(req *string) (*string, error) {
+		calls++
+		if calls == 1 {
+			return nil, errors.New("not ready")
+		}
+		return req, nil
+	}, WithCache(CacheConf{TTL: time.Millisecond * 50}))
+
+	for i := 0; i < 3; i++ {
+		call(working, "lookup")
+	}
+	if calls != 2 {
+		t.Fatalf("error response should not be cached, calls %d", calls)
+	}
+	rs := router.Stats().Routes[0]
+	if rs.CacheHits != 1 || rs.CacheMisses != 2 || rs.Calls != 2 {
+		t.Fatalf("unexpected stats %+v", rs)
+	}
+	time.Sleep(time.Millisecond * 60)
+	if res, _ := call(working, "lookup"); res != "lookup" || calls != 3 {
+		t.Fatalf("expired response should not be used, %s %d", res, calls)
+	}
+}
+
+func TestRespCacheEviction(t *testing.T) {
+	c := newRespCache(CacheConf{TTL: time.Minute, MaxEntries: 2, MaxBytes: 12})
+	c.put([]byte("a"), []byte("11"))
+	c.put([]byte("b"), []byte("22"))
+	c.get([]byte("a"))
+	c.put([]byte("c"), []byte("33"))
+	if _, ok := c.get([]byte("b")); ok {
+		t.Fatal("least recently used entry should be evicted")
+	}
+	if _, ok := c.get([]byte("a")); !ok {
+		t.Fatal("recently used entry should be kept")
+	}
+	c.put([]byte("d"), []byte("4444444444"))
+	if _, ok := c.get([]byte("a")); ok || c.bytes > 12 || c.lru.Len() != 1 {
+		t.Fatalf("entries should be evicted by bytes, bytes %d len %d", c.bytes, c.lru.Len())
+	}
+	c.put([]byte("e"), make([]byte, 20))
+	if _, ok := c.get([]byte("e")); ok {
+		t.Fatal("entry larger than MaxBytes should not be cached")
+	}
+}
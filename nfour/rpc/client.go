@@ -4,22 +4,45 @@
 package rpc
 
 import (
-	"github.com/rolandhe/saber/nfour/duplex"
+	"context"
+	"github.com/rolandhe/saber/gocc"
+	"github.com/rolandhe/saber/nfour"
+	"sync/atomic"
+	"time"
 )
 
 // Client 描述rpc的客户端
 type Client[REQ any, RES any] struct {
-	codec ClientCodec[REQ, RES]
-	trans *duplex.Trans
+	codec        ClientCodec[REQ, RES]
+	trans        []Transport
+	next         atomic.Uint64
+	keyExtractor func(req *REQ) any
+	retry        *RetryPolicy
+	breaker      *nfour.CircuitBreaker
+	limiter      gocc.RateLimiter
+	keyLimiters  map[any]gocc.RateLimiter
+	hedge        *HedgePolicy
+	latency      *latencyTracker
 }
 
 // NewClient 构建rpc 客户端
 //
 // codec 请求编解码，可以把一个struct对象 编码成二进制，也可以把二进制解码成对象
-func NewClient[REQ any, RES any](codec ClientCodec[REQ, RES], cli *duplex.Trans) *Client[REQ, RES] {
+//
+// trans 底层的二进制传输，比如 duplex.Trans、simplex.Client
+func NewClient[REQ any, RES any](codec ClientCodec[REQ, RES], trans Transport) *Client[REQ, RES] {
+	return NewMultiTransClient[REQ, RES](codec, trans)
+}
+
+// NewMultiTransClient 构建基于多个 Transport 的rpc 客户端，请求轮询的发送到各个 Transport，重试时会切换到另一个 Transport
+//
+// codec 请求编解码，可以把一个struct对象 编码成二进制，也可以把二进制解码成对象
+//
+// trans 为空时请求返回 nfour.ErrTransShutdown
+func NewMultiTransClient[REQ any, RES any](codec ClientCodec[REQ, RES], trans ...Transport) *Client[REQ, RES] {
 	return &Client[REQ, RES]{
 		codec: codec,
-		trans: cli,
+		trans: trans,
 	}
 }
 
@@ -31,17 +54,105 @@ type ClientCodec[REQ any, RES any] interface {
 	Encode(req *REQ) ([]byte, error)
 }
 
+// WithKeyExtractor 设置rpc方法名称提取工具，重试策略等需要根据方法名称区分请求
+func (c *Client[REQ, RES]) WithKeyExtractor(kExtractor func(req *REQ) any) *Client[REQ, RES] {
+	c.keyExtractor = kExtractor
+	return c
+}
+
+// WithRetryPolicy 设置重试策略，nil表示不重试
+func (c *Client[REQ, RES]) WithRetryPolicy(policy *RetryPolicy) *Client[REQ, RES] {
+	c.retry = policy
+	return c
+}
+
+// WithCircuitBreaker 设置客户端级别的熔断器，它统计所有请求(包括重试)的最终结果，打开时请求直接返回 nfour.ErrCircuitOpen。
+// 与 duplex.TransConf 中单个连接的熔断器不同，它用于整个下游服务不可用的场景
+func (c *Client[REQ, RES]) WithCircuitBreaker(breaker *nfour.CircuitBreaker) *Client[REQ, RES] {
+	c.breaker = breaker
+	return c
+}
+
+// WithRateLimiter 设置客户端的QPS限流
+//
+// global 所有请求共享的限流器，可以为nil
+//
+// perKey 按照方法名称设置的限流器，方法名称由 WithKeyExtractor 设置的提取工具提取，可以为nil
+//
+// 请求需要先后获得方法级别和全局的许可，最多等待 ReqTimeout.WaitConcurrent，获取不到时返回 nfour.ExceedRateLimitError。
+// 被方法级别限流拒绝的请求不消耗全局许可；但是 gocc.RateLimiter 无法归还许可，被全局限流拒绝的请求已经消耗了方法级别的许可，
+// 全局限流频繁拒绝时方法的实际QPS会低于 perKey 的设置，因此 global 的容量应该大于 perKey 中各方法的容量
+func (c *Client[REQ, RES]) WithRateLimiter(global gocc.RateLimiter, perKey map[any]gocc.RateLimiter) *Client[REQ, RES] {
+	c.limiter = global
+	c.keyLimiters = perKey
+	return c
+}
+
+// WithHedging 设置对冲请求策略，只有存在多个 Transport 时才会发送对冲请求，nil表示不对冲。
+// 超出取值范围的 Percentile、MinDelay 会被修正，MaxDelay 小于等于0时不对冲，见 HedgePolicy
+func (c *Client[REQ, RES]) WithHedging(policy *HedgePolicy) *Client[REQ, RES] {
+	c.hedge = policy.normalize()
+	c.latency = newLatencyTracker()
+	return c
+}
+
+// BreakerState 获取客户端级别熔断器的状态，没有设置熔断器时总是返回 nfour.BreakerClosed
+func (c *Client[REQ, RES]) BreakerState() nfour.BreakerState {
+	if c.breaker == nil {
+		return nfour.BreakerClosed
+	}
+	return c.breaker.State()
+}
+
 // SendRequest 发送业务对象请求并返回业务对象类型的响应值，底层通过编解码转成二进制后通过tcp发送
 //
 // req 业务对象类型的请求
 //
 // reqTimeout 超时配置
-func (c *Client[REQ, RES]) SendRequest(req *REQ, reqTimeout *duplex.ReqTimeout) (*RES, error) {
+//
+// 服务端返回的框架级错误(过载、方法不存在等)以 *nfour.StatusError 返回，业务错误仍然由codec解码成业务对象
+//
+// 如果设置了重试策略，可以重试的错误会按照策略重试，存在多个 Transport 时每次重试使用不同的 Transport
+func (c *Client[REQ, RES]) SendRequest(req *REQ, reqTimeout *nfour.ReqTimeout) (*RES, error) {
+	return c.send(req, reqTimeout, nil)
+}
+
+// SendRequestContext 与 SendRequest 相同，但请求受 ctx 控制：ctx 已经结束时直接返回 ctx.Err()；
+// ctx 的截止时间作为 ReadTimeout 的上限；等待响应时 ctx 被取消，支持取消的 Transport(见 CancelableTransport)会立即返回，此时返回 ctx.Err()
+func (c *Client[REQ, RES]) SendRequestContext(ctx context.Context, req *REQ, reqTimeout *nfour.ReqTimeout) (*RES, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		rt := nfour.ReqTimeout{}
+		if reqTimeout != nil {
+			rt = *reqTimeout
+		}
+		if rt.ReadTimeout <= 0 || rt.ReadTimeout > remaining {
+			rt.ReadTimeout = remaining
+		}
+		reqTimeout = &rt
+	}
+	res, err := c.send(req, reqTimeout, ctx.Done())
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return res, err
+}
+
+func (c *Client[REQ, RES]) send(req *REQ, reqTimeout *nfour.ReqTimeout, cancel <-chan struct{}) (*RES, error) {
+	if !c.admitRate(req, reqTimeout) {
+		return nil, nfour.ExceedRateLimitError
+	}
 	payload, err := c.codec.Encode(req)
 	if err != nil {
 		return nil, err
 	}
-	resBuff, err := c.trans.SendPayload(payload, reqTimeout)
+	resBuff, err := c.sendWithBreaker(req, payload, reqTimeout, cancel)
 	if err != nil {
 		return nil, err
 	}
@@ -52,8 +163,94 @@ func (c *Client[REQ, RES]) SendRequest(req *REQ, reqTimeout *duplex.ReqTimeout)
 	return res, nil
 }
 
-// Shutdown 关闭客户端，底层的Trans及连接资源会被释放
+func (c *Client[REQ, RES]) admitRate(req *REQ, reqTimeout *nfour.ReqTimeout) bool {
+	if c.limiter == nil && len(c.keyLimiters) == 0 {
+		return true
+	}
+	var wait time.Duration
+	if reqTimeout != nil {
+		wait = reqTimeout.WaitConcurrent
+	}
+	// 先获取方法级别的许可，被方法级别限流拒绝的请求不会消耗全局许可，被全局限流拒绝时方法级别的许可无法归还，见 WithRateLimiter
+	if l, ok := c.keyLimiters[c.key(req)]; ok && !l.AcquireTimeout(wait) {
+		return false
+	}
+	return c.limiter == nil || c.limiter.AcquireTimeout(wait)
+}
+
+func (c *Client[REQ, RES]) sendWithBreaker(req *REQ, payload []byte, reqTimeout *nfour.ReqTimeout, cancel <-chan struct{}) ([]byte, error) {
+	if c.breaker == nil {
+		return c.sendWithRetry(req, payload, reqTimeout, cancel)
+	}
+	ticket, err := c.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	resBuff, err := c.sendWithRetry(req, payload, reqTimeout, cancel)
+	c.breaker.Done(ticket, err)
+	return resBuff, err
+}
+
+// sendWithRetry cancel 被关闭后不再重试，退避等待也会被中断。没有 Transport 时返回 nfour.ErrTransShutdown
+func (c *Client[REQ, RES]) sendWithRetry(req *REQ, payload []byte, reqTimeout *nfour.ReqTimeout, cancel <-chan struct{}) ([]byte, error) {
+	if len(c.trans) == 0 {
+		return nil, nfour.ErrTransShutdown
+	}
+	start := c.next.Add(1)
+	attempt := 1
+	hedged := c.hedge != nil && len(c.trans) > 1 && c.hedge.ReadOnly != nil && c.hedge.ReadOnly(c.key(req))
+	for {
+		seq := start + uint64(attempt-1)
+		trans := c.pick(seq)
+		var resBuff []byte
+		var err error
+		if secondary := c.pick(seq + 1); hedged && secondary != trans {
+			resBuff, err = c.sendHedged(payload, reqTimeout, trans, secondary, cancel)
+		} else {
+			resBuff, err = sendPayloadCancel(trans, payload, reqTimeout, cancel)
+		}
+		if err == nil || c.retry == nil || !c.retry.canRetry(err, attempt, c.key(req)) {
+			return resBuff, err
+		}
+		if !c.retry.backoff(attempt, cancel) {
+			return nil, nfour.ErrTaskCancelled
+		}
+		attempt++
+	}
+}
+
+// pick 从 seq 对应的 Transport 开始选择第一个可用的 Transport，如果全部不可用，返回 seq 对应的 Transport，由它返回对应的错误
+func (c *Client[REQ, RES]) pick(seq uint64) Transport {
+	n := uint64(len(c.trans))
+	for i := uint64(0); i < n; i++ {
+		t := c.trans[(seq+i)%n]
+		if isAvailable(t) {
+			return t
+		}
+	}
+	return c.trans[seq%n]
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client[REQ, RES]) key(req *REQ) any {
+	if c.keyExtractor == nil {
+		return nil
+	}
+	return c.keyExtractor(req)
+}
+
+// Shutdown 关闭客户端，底层的Transport及连接资源会被释放
 // source 关闭客户端的场景，会输出到日志，方便排除问题
 func (c *Client[REQ, RES]) Shutdown(source string) {
-	c.trans.Shutdown(source)
+	for _, t := range c.trans {
+		t.Shutdown(source)
+	}
 }
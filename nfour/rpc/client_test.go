@@ -0,0 +1,174 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"github.com/rolandhe/saber/gocc"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/loopback"
+	"testing"
+	"time"
+)
+
+type bytesCodec struct {
+}
+
+func (bytesCodec) Decode(payload []byte) (*string, error) {
+	s := string(payload)
+	return &s, nil
+}
+
+func (bytesCodec) Encode(req *string) ([]byte, error) {
+	return []byte(*req), nil
+}
+
+type fakeTransport struct {
+	err   error
+	calls int
+}
+
+func (f *fakeTransport) SendPayload(req []byte, reqTimeout *nfour.ReqTimeout) ([]byte, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return req, nil
+}
+
+func (f *fakeTransport) Shutdown(source string) {
+}
+
+func TestClientOverLoopback(t *testing.T) {
+	working, router := NewRpcWorking[string, string](bytesCodec{}, func(req *string) any {
+		return *req
+	}, func(err error, interfaceName any) *string {
+		s := "err:" + err.Error()
+		return &s
+	})
+	router.Register("ping", func(req *string) (*string, error) {
+		s := "pong"
+		return &s, nil
+	})
+
+	c := NewClient[string, string](bytesCodec{}, loopback.NewTrans(working, "test"))
+	req := "ping"
+	res, err := c.SendRequest(&req, nil)
+	if err != nil || *res != "pong" {
+		t.Fatalf("unexpected result %v %v", res, err)
+	}
+
+	req = "missing"
+	if _, err = c.SendRequest(&req, nil); !errors.Is(err, nfour.ErrNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+}
+
+func TestRetryHopsToAnotherTransport(t *testing.T) {
+	overloaded := &fakeTransport{err: nfour.NewStatusError(nfour.StatusOverloaded, "busy")}
+	healthy := &fakeTransport{}
+	c := NewMultiTransClient[string, string](bytesCodec{}, overloaded, healthy).
+		WithRetryPolicy(&RetryPolicy{MaxAttempts: 2})
+
+	for i := 0; i < 4; i++ {
+		req := "hello"
+		res, err := c.SendRequest(&req, nil)
+		if err != nil || *res != "hello" {
+			t.Fatalf("unexpected result %v %v", res, err)
+		}
+	}
+	if healthy.calls != 4 {
+		t.Fatalf("expect 4 calls on healthy transport, got %d", healthy.calls)
+	}
+}
+
+func TestRetryRespectsIdempotency(t *testing.T) {
+	timeout := &fakeTransport{err: nfour.ErrTaskTimeout}
+	c := NewClient[string, string](bytesCodec{}, timeout).
+		WithKeyExtractor(func(req *string) any {
+			return *req
+		}).
+		WithRetryPolicy(&RetryPolicy{MaxAttempts: 3, Idempotent: IdempotentKeys("get")})
+
+	write := "put"
+	if _, err := c.SendRequest(&write, nil); !errors.Is(err, nfour.ErrTaskTimeout) {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	if timeout.calls != 1 {
+		t.Fatalf("non-idempotent request should not be retried, calls:%d", timeout.calls)
+	}
+
+	read := "get"
+	c.SendRequest(&read, nil)
+	if timeout.calls != 4 {
+		t.Fatalf("idempotent request should be tried 3 times, calls:%d", timeout.calls-1)
+	}
+}
+
+func TestKeyRateLimitDoesNotConsumeGlobal(t *testing.T) {
+	global := gocc.NewTokenBucketLimiter(0.001, 2)
+	c := NewClient[string, string](bytesCodec{}, &fakeTransport{}).
+		WithKeyExtractor(func(req *string) any { return *req }).
+		WithRateLimiter(global, map[any]gocc.RateLimiter{"report": gocc.NewTokenBucketLimiter(0.001, 1)})
+	for i, key := range []string{"report", "report", "report", "ping"} {
+		req := key
+		_, err := c.SendRequest(&req, nil)
+		if i == 0 || i == 3 {
+			if err != nil {
+				t.Fatalf("request %d should pass, got %v", i, err)
+			}
+			continue
+		}
+		if !errors.Is(err, nfour.ExceedRateLimitError) {
+			t.Fatalf("request %d should be limited, got %v", i, err)
+		}
+	}
+}
+
+func TestSendRequestContext(t *testing.T) {
+	c := NewClient[string, string](bytesCodec{}, newPipeTrans(time.Millisecond*500, nil))
+	defer c.Shutdown("test")
+	req := "slow"
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := c.SendRequestContext(ctx, &req, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect context.DeadlineExceeded, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*20, cancel)
+	start := time.Now()
+	if _, err := c.SendRequestContext(ctx, &req, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled, got %v", err)
+	}
+	if cost := time.Since(start); cost >= time.Millisecond*500 {
+		t.Fatalf("cancel did not interrupt the request: %v", cost)
+	}
+}
+
+func TestRetryBackoffCancel(t *testing.T) {
+	overloaded := &fakeTransport{err: nfour.NewStatusError(nfour.StatusOverloaded, "busy")}
+	c := NewClient[string, string](bytesCodec{}, overloaded).
+		WithRetryPolicy(&RetryPolicy{MaxAttempts: 3, Backoff: func(attempt int) time.Duration {
+			return time.Second * 5
+		}})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*20, cancel)
+	start := time.Now()
+	req := "hello"
+	if _, err := c.SendRequestContext(ctx, &req, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled, got %v", err)
+	}
+	if cost := time.Since(start); cost >= time.Second {
+		t.Fatalf("cancel did not interrupt the backoff: %v", cost)
+	}
+}
+
+func TestClientWithoutTransport(t *testing.T) {
+	c := NewMultiTransClient[string, string](bytesCodec{})
+	req := "hello"
+	if _, err := c.SendRequest(&req, nil); !errors.Is(err, nfour.ErrTransShutdown) {
+		t.Fatalf("expect ErrTransShutdown, got %v", err)
+	}
+	c.Shutdown("test")
+}
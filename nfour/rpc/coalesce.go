@@ -0,0 +1,65 @@
+// rpc abstraction basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package rpc
+
+import (
+	"bytes"
+	"github.com/rolandhe/saber/gocc"
+	"github.com/rolandhe/saber/hash"
+	"github.com/rolandhe/saber/nfour"
+	"sync"
+	"sync/atomic"
+)
+
+// errCoalescedPanic 合并执行的业务处理函数发生panic，等待该结果的请求返回 nfour.StatusInternal
+var errCoalescedPanic = nfour.NewStatusError(nfour.StatusInternal, "coalesced request failed")
+
+// WithCoalescing 合并同一方法并发的相同请求，请求数据相同的请求在执行期间只执行一次业务处理函数，编码后的响应(包括错误)由所有请求共享。
+// 适用于幂等方法，与 WithCache 同时使用时先查询缓存
+func WithCoalescing() RouteOption {
+	return func(opts *routeOptions) {
+		opts.coalescer = &coalescer{flights: map[uint64]*flight{}}
+	}
+}
+
+// flight 正在执行的请求，等待者通过 future 获取结果
+type flight struct {
+	payload []byte
+	future  *gocc.Future
+}
+
+type coalescer struct {
+	lock    sync.Mutex
+	flights map[uint64]*flight
+	shared  atomic.Int64
+}
+
+// do 以请求数据的 hash.CityHash64 查找正在执行的相同请求，hash相同但请求数据不同时不合并
+func (c *coalescer) do(payload []byte, fn func() ([]byte, error)) (buf []byte, err error) {
+	h := hash.CityHash64(payload, uint(len(payload)))
+	c.lock.Lock()
+	if f, ok := c.flights[h]; ok {
+		c.lock.Unlock()
+		if !bytes.Equal(f.payload, payload) {
+			return fn()
+		}
+		c.shared.Add(1)
+		v, err := f.future.Get()
+		buf, _ = v.([]byte)
+		return buf, err
+	}
+	f := &flight{payload: payload, future: gocc.NewPendingFuture()}
+	c.flights[h] = f
+	c.lock.Unlock()
+
+	err = errCoalescedPanic
+	defer func() {
+		c.lock.Lock()
+		delete(c.flights, h)
+		c.lock.Unlock()
+		f.future.Complete(buf, err)
+	}()
+	buf, err = fn()
+	return buf, err
+}
@@ -0,0 +1,46 @@
+package rpc
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRouteCoalescing(t *testing.T) {
+	working, router := newStringRouter()
+	block := make(chan struct{})
+	var calls atomic.Int64
+	router.Register("report", func(req *string) (*string, error) {
+		calls.Add(1)
+		<-block
+		return req, nil
+	}, WithCoalescing())
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := call(working, "report"); err != nil || res != "report" {
+				t.Errorf("unexpected result %s %v", res, err)
+			}
+		}()
+	}
+	deadline := time.Now().Add(time.Second)
+	for router.Stats().Routes[0].Coalesced != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("requests are not coalesced, %+v", router.Stats().Routes[0])
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(block)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Fatalf("expect one handler call, got %d", calls.Load())
+	}
+
+	if res, _ := call(working, "report"); res != "report" || calls.Load() != 2 {
+		t.Fatal("finished request should not be shared")
+	}
+}
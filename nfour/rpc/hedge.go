@@ -0,0 +1,167 @@
+// rpc abstraction basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package rpc
+
+import (
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/utils/sortutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	latencyWindowSize     = 1024
+	latencyRefreshEvery   = 64
+	latencyMinSampleCount = 32
+)
+
+// HedgePolicy 对冲请求策略。只读的请求在第一个连接上超过一定延迟仍然没有响应时，会在另一个连接上发送相同的请求，
+// 使用先返回的成功响应，并取消另一个请求，以此降低长尾延迟
+type HedgePolicy struct {
+	// Percentile 对冲延迟取最近成功请求耗时的百分位，取值(0,1]，比如0.95表示请求耗时超过p95时发送对冲请求。
+	// 大于1时按1处理，小于等于0时使用 DefaultHedgePercentile
+	Percentile float64
+	// MinDelay 对冲延迟的下限，大于 MaxDelay 时按 MaxDelay 处理
+	MinDelay time.Duration
+	// MaxDelay 对冲延迟的上限，样本不足时也使用该值，必须大于0，否则不发送对冲请求
+	MaxDelay time.Duration
+	// ReadOnly 根据方法名称判断请求是否只读，只有只读请求才会被对冲，方法名称由 Client.WithKeyExtractor 设置的提取工具提取
+	ReadOnly func(key any) bool
+}
+
+// DefaultHedgePercentile HedgePolicy.Percentile 不合法时使用的百分位
+const DefaultHedgePercentile = 0.95
+
+// normalize 返回修正了取值范围的策略副本，MaxDelay 不合法时返回nil，表示不对冲
+func (p *HedgePolicy) normalize() *HedgePolicy {
+	if p == nil {
+		return nil
+	}
+	if p.MaxDelay <= 0 {
+		nfour.NFourLogger.Info("invalid hedge max delay %v, hedging disabled\n", p.MaxDelay)
+		return nil
+	}
+	np := *p
+	if !(np.Percentile > 0) {
+		np.Percentile = DefaultHedgePercentile
+	} else if np.Percentile > 1 {
+		np.Percentile = 1
+	}
+	if np.MinDelay < 0 {
+		np.MinDelay = 0
+	}
+	if np.MinDelay > np.MaxDelay {
+		np.MinDelay = np.MaxDelay
+	}
+	return &np
+}
+
+// latencyTracker 记录最近请求的耗时，并周期性的计算指定百分位的耗时
+type latencyTracker struct {
+	lock    sync.Mutex
+	samples []time.Duration
+	pos     int
+	count   int
+	delay   atomic.Int64
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		samples: make([]time.Duration, latencyWindowSize),
+	}
+}
+
+func (lt *latencyTracker) record(cost time.Duration, policy *HedgePolicy) {
+	lt.lock.Lock()
+	defer lt.lock.Unlock()
+	lt.samples[lt.pos] = cost
+	lt.pos = (lt.pos + 1) % len(lt.samples)
+	lt.count++
+	if lt.count < latencyMinSampleCount || lt.count%latencyRefreshEvery != 0 {
+		return
+	}
+	n := lt.count
+	if n > len(lt.samples) {
+		n = len(lt.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, lt.samples[:n])
+	sortutil.Cmp[time.Duration](func(p1, p2 *time.Duration) bool {
+		return *p1 < *p2
+	}).Sort(sorted)
+	idx := int(float64(n-1) * policy.Percentile)
+	lt.delay.Store(int64(sorted[idx]))
+}
+
+func (lt *latencyTracker) hedgeDelay(policy *HedgePolicy) time.Duration {
+	d := time.Duration(lt.delay.Load())
+	if d == 0 || d > policy.MaxDelay {
+		return policy.MaxDelay
+	}
+	if d < policy.MinDelay {
+		return policy.MinDelay
+	}
+	return d
+}
+
+type hedgeResult struct {
+	res []byte
+	err error
+}
+
+// sendHedged 先在 primary 上发送请求，超过对冲延迟仍没有响应时在 secondary 上发送相同的请求，返回先到达的成功响应并取消另一个请求;
+// 两个请求都失败时返回先失败的错误；cancel 被关闭时取消两个请求并返回 nfour.ErrTaskCancelled
+func (c *Client[REQ, RES]) sendHedged(payload []byte, reqTimeout *nfour.ReqTimeout, primary Transport, secondary Transport, cancel <-chan struct{}) ([]byte, error) {
+	resultCh := make(chan *hedgeResult, 2)
+	cancels := []chan struct{}{make(chan struct{}), make(chan struct{})}
+	closeAll := func() {
+		for _, ch := range cancels {
+			close(ch)
+		}
+	}
+	send := func(t Transport, stop chan struct{}) {
+		var rt *nfour.ReqTimeout
+		if reqTimeout != nil {
+			copied := *reqTimeout
+			rt = &copied
+		}
+		start := time.Now()
+		res, err := sendPayloadCancel(t, payload, rt, stop)
+		if err == nil {
+			c.latency.record(time.Since(start), c.hedge)
+		}
+		resultCh <- &hedgeResult{res, err}
+	}
+
+	go send(primary, cancels[0])
+	timer := time.NewTimer(c.latency.hedgeDelay(c.hedge))
+	defer timer.Stop()
+
+	inflight := 1
+	var firstErr error
+	for {
+		select {
+		case r := <-resultCh:
+			inflight--
+			if r.err == nil {
+				closeAll()
+				return r.res, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			// primary 在对冲前就失败时不再发送对冲请求，由重试策略处理
+			if inflight == 0 {
+				return nil, firstErr
+			}
+		case <-timer.C:
+			inflight++
+			go send(secondary, cancels[1])
+		case <-cancel:
+			closeAll()
+			return nil, nfour.ErrTaskCancelled
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"net"
+	"testing"
+	"time"
+)
+
+func newPipeTrans(delay time.Duration, breaker *nfour.CircuitBreaker) *duplex.Trans {
+	srvConn, cliConn := net.Pipe()
+	working := func(task *nfour.Task) ([]byte, error) {
+		time.Sleep(delay)
+		return task.PayLoad, nil
+	}
+	duplex.ServeConn(srvConn, nfour.NewSrvConf(working, func(err error) []byte { return nil }, 10))
+	conf := duplex.NewTransConf(time.Second, 10)
+	conf.Breaker = breaker
+	return duplex.NewTransWithConn(cliConn, conf, "pipe")
+}
+
+func TestHedgingKeepsLoserBreakerClosed(t *testing.T) {
+	breaker := nfour.NewCircuitBreaker(&nfour.BreakerConf{
+		WindowSize:           10,
+		MinCalls:             2,
+		FailureRateThreshold: 0.5,
+		OpenDuration:         time.Second,
+	}, "slow")
+	slow := newPipeTrans(time.Millisecond*200, breaker)
+	fast := newPipeTrans(0, nil)
+	c := NewMultiTransClient[string, string](bytesCodec{}, slow, fast).
+		WithKeyExtractor(func(req *string) any { return *req }).
+		WithHedging(&HedgePolicy{MaxDelay: time.Millisecond * 5, ReadOnly: func(key any) bool { return true }})
+	defer c.Shutdown("test")
+
+	for i := 0; i < 6; i++ {
+		req := "get"
+		start := time.Now()
+		res, err := c.SendRequest(&req, nil)
+		if err != nil || *res != "get" {
+			t.Fatalf("unexpected result %v %v", res, err)
+		}
+		if cost := time.Since(start); cost >= time.Millisecond*200 {
+			t.Fatalf("request %d was not hedged, cost %v", i, cost)
+		}
+	}
+	if m := breaker.Metrics(); m.State != nfour.BreakerClosed || m.Failures != 0 {
+		t.Fatalf("cancelled hedge losers should not count as failures: %+v", m)
+	}
+}
+
+func TestHedgePolicyNormalize(t *testing.T) {
+	c := NewMultiTransClient[string, string](bytesCodec{}, &fakeTransport{}, &fakeTransport{}).
+		WithHedging(&HedgePolicy{Percentile: 1.5, MinDelay: time.Millisecond * 20, MaxDelay: time.Millisecond * 10})
+	if c.hedge.Percentile != 1 || c.hedge.MinDelay != time.Millisecond*10 {
+		t.Fatalf("policy not normalized: %+v", c.hedge)
+	}
+	for i := 0; i < latencyRefreshEvery*2; i++ {
+		c.latency.record(time.Duration(i)*time.Microsecond, c.hedge)
+	}
+	if d := c.latency.hedgeDelay(c.hedge); d != time.Millisecond*10 {
+		t.Fatalf("expect delay clamped to min delay, got %v", d)
+	}
+
+	c.WithHedging(&HedgePolicy{Percentile: -1, MaxDelay: time.Millisecond})
+	if c.hedge.Percentile != DefaultHedgePercentile {
+		t.Fatalf("expect default percentile, got %v", c.hedge.Percentile)
+	}
+	if c.WithHedging(&HedgePolicy{Percentile: 0.9}).hedge != nil {
+		t.Fatal("zero max delay should disable hedging")
+	}
+}
@@ -0,0 +1,395 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rolandhe/saber/gocc"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"github.com/rolandhe/saber/nfour/rpc"
+	"sync"
+	"time"
+)
+
+// BatchKey 内置的批量请求方法名称，一个批量请求包含多个请求，服务端逐个分发后一次性返回所有的响应
+const BatchKey = "_nfour.batch"
+
+// MaxBatchItems 单个批量请求最多包含的请求数，超出时整个批量请求失败，错误交给 HandleErrorFunc 处理
+var MaxBatchItems = 1000
+
+var (
+	// ErrBatcherShutdown Batcher 已经关闭
+	ErrBatcherShutdown = errors.New("batcher is shutdown")
+	// ErrBatchMismatch 批量响应的数量与请求不一致
+	ErrBatchMismatch = errors.New("batch response mismatch")
+)
+
+// BatchReq 批量请求，编码成json后作为 BatchKey 请求的 Body
+type BatchReq struct {
+	Items []*BatchItemReq `json:"items"`
+}
+
+// BatchItemReq 批量请求中的单个请求。json格式的请求数据直接嵌入 Body，避免再次被编码成base64，
+// 其他格式的数据(比如 FactoryStringTypeHandleBiz 的字符串)使用 Raw
+type BatchItemReq struct {
+	Key  string          `json:"key"`
+	Body json.RawMessage `json:"body,omitempty"`
+	Raw  []byte          `json:"raw,omitempty"`
+}
+
+// BatchRes 批量响应，Items 与请求一一对应
+type BatchRes struct {
+	Items []*BatchItemRes `json:"items"`
+}
+
+// BatchItemRes 批量响应中的单个响应，Body 和 Raw 的含义与 BatchItemReq 相同
+type BatchItemRes struct {
+	Key  string          `json:"key"`
+	Body json.RawMessage `json:"body,omitempty"`
+	Raw  []byte          `json:"raw,omitempty"`
+	// Error 业务错误，同 JsonProtoRes.Error
+	Error *ResError `json:"error,omitempty"`
+	// Status 框架级错误(方法不存在、过载等)的状态码，nfour.StatusOK 表示 Body 是业务响应，业务错误由 HandleErrorFunc 转换
+	Status  nfour.Status `json:"status,omitempty"`
+	Message string       `json:"message,omitempty"`
+}
+
+// BatchResult 客户端批量请求中单个请求的结果，Err 是框架级错误，与 JsonClient.SendRequest 返回的错误一致
+type BatchResult struct {
+	Res *JsonProtoRes
+	Err error
+}
+
+// RegisterBatch 在 router 上注册 BatchKey 方法，需要显式调用。批量请求中的请求不受服务端(nfour.SrvConf)的限流和并发约束，
+// 需要时使用 RegisterBatchWithConf。这些请求共享批量请求本身占用的服务端并发，超时(rpc.WithTimeout)的请求在业务处理函数返回之前一直占用该并发
+//
+// executor 不为nil时批量请求中的请求通过 executor 并行执行，executor 资源耗尽时在当前goroutine中执行；为nil时顺序执行
+//
+// opts 批量方法本身的设置，批量请求中的每个请求仍然受各自方法的设置约束
+func RegisterBatch(router *rpc.SrvRouter[JsonProtoReq, JsonProtoRes], executor gocc.Executor, opts ...rpc.RouteOption) {
+	RegisterBatchWithConf(router, nil, executor, opts...)
+}
+
+// RegisterBatchWithConf 与 RegisterBatch 相同，但批量请求中的每个请求都计入 conf 的准入控制：
+//   - 除第一个请求外，每个请求都需要通过 conf 的限流，被拒绝的请求返回 nfour.ErrRejectedRateLimit
+//   - 并行执行的请求需要获取 conf 的并发许可，无法获取时在当前goroutine中执行，使用批量请求本身的许可，因此服务端的实际并发不会超过配置
+//
+// conf 通常是启动服务使用的 nfour.SrvConf，为nil时与 RegisterBatch 相同
+func RegisterBatchWithConf(router *rpc.SrvRouter[JsonProtoReq, JsonProtoRes], conf *nfour.SrvConf, executor gocc.Executor, opts ...rpc.RouteOption) {
+	router.RegisterContext(BatchKey, func(ctx context.Context, req *JsonProtoReq) (*JsonProtoRes, error) {
+		batch := &BatchReq{}
+		if err := req.jsonOpts.Unmarshal(req.Body, batch); err != nil {
+			return nil, nfour.NewStatusError(nfour.StatusBadRequest, err.Error())
+		}
+		if len(batch.Items) > MaxBatchItems {
+			return nil, nfour.NewStatusError(nfour.StatusBadRequest, fmt.Sprintf("batch items %d exceed %d", len(batch.Items), MaxBatchItems))
+		}
+		items := make([]*JsonProtoReq, len(batch.Items))
+		for i, item := range batch.Items {
+			if item != nil {
+				items[i] = &JsonProtoReq{Key: item.Key, Body: item.payload(), jsonOpts: req.jsonOpts}
+			}
+		}
+		ret := &BatchRes{Items: dispatchBatch(router, conf, executor, items, rpc.TaskOf(ctx))}
+		body, err := json.Marshal(ret)
+		if err != nil {
+			return nil, err
+		}
+		return &JsonProtoRes{Key: req.Key, Body: body}, nil
+	}, opts...)
+}
+
+// payload 请求数据，Body 为空时使用 Raw
+func (item *BatchItemReq) payload() []byte {
+	if len(item.Body) > 0 {
+		return item.Body
+	}
+	return item.Raw
+}
+
+func newBatchItemReq(req *JsonProtoReq) *BatchItemReq {
+	if req == nil {
+		return nil
+	}
+	item := &BatchItemReq{Key: req.Key}
+	if embeddable(req.Body) {
+		item.Body = req.Body
+	} else {
+		item.Raw = req.Body
+	}
+	return item
+}
+
+// payload 响应数据，Body 为空时使用 Raw
+func (item *BatchItemRes) payload() []byte {
+	if len(item.Body) > 0 {
+		return item.Body
+	}
+	return item.Raw
+}
+
+func newBatchItemRes(res *JsonProtoRes) *BatchItemRes {
+	item := &BatchItemRes{Key: res.Key, Error: res.Error}
+	if embeddable(res.Body) {
+		item.Body = res.Body
+	} else {
+		item.Raw = res.Body
+	}
+	return item
+}
+
+// embeddable 数据可以原样嵌入json。json.Marshal 会压缩嵌入的json并转义html字符，这类数据使用base64，保证业务数据不被修改
+func embeddable(data []byte) bool {
+	if len(data) == 0 || bytes.ContainsAny(data, "<>&\u2028\u2029") {
+		return false
+	}
+	buf := &bytes.Buffer{}
+	return json.Compact(buf, data) == nil && bytes.Equal(buf.Bytes(), data)
+}
+
+// dispatchBatch own 是批量请求本身占用的服务端并发，没有单独获取并发的请求使用它
+func dispatchBatch(router *rpc.SrvRouter[JsonProtoReq, JsonProtoRes], conf *nfour.SrvConf, executor gocc.Executor, items []*JsonProtoReq, own *nfour.Task) []*BatchItemRes {
+	results := make([]*BatchItemRes, len(items))
+	// 第一个请求使用批量请求本身的限流许可
+	admitted := func(i int) bool {
+		return conf == nil || i == 0 || conf.AdmitRate()
+	}
+	if executor == nil {
+		for i, item := range items {
+			if !admitted(i) {
+				results[i] = batchItemErr(item, nfour.ErrRejectedRateLimit)
+				continue
+			}
+			results[i] = handleBatchItem(router, item, own)
+		}
+		return results
+	}
+	futures := make([]*gocc.Future, len(items))
+	for i, item := range items {
+		if !admitted(i) {
+			results[i] = batchItemErr(item, nfour.ErrRejectedRateLimit)
+			continue
+		}
+		task := own
+		if conf != nil {
+			if !conf.GetConcurrent().AcquireTimeout(conf.SemaWaitTime) {
+				results[i] = handleBatchItem(router, item, own)
+				continue
+			}
+			task = nfour.NewTask(nil, conf.GetConcurrent().Release)
+		}
+		item, task := item, task
+		// 单独获取的并发在请求处理结束后释放，批量请求本身的并发由通信层释放
+		done := func() {
+			if task != own {
+				task.Done()
+			}
+		}
+		future, ok := executor.Execute(func() (any, error) {
+			defer done()
+			return handleBatchItem(router, item, task), nil
+		})
+		if !ok {
+			results[i] = handleBatchItem(router, item, task)
+			done()
+			continue
+		}
+		futures[i] = future
+	}
+	for i, future := range futures {
+		if future == nil {
+			continue
+		}
+		v, err := future.Get()
+		if err != nil {
+			results[i] = batchItemErr(items[i], err)
+			continue
+		}
+		results[i] = v.(*BatchItemRes)
+	}
+	return results
+}
+
+// handleBatchItem task 是请求占用的服务端并发，单独获取的并发或者批量请求本身的并发，业务处理超时时由 task.Hold 接管
+func handleBatchItem(router *rpc.SrvRouter[JsonProtoReq, JsonProtoRes], item *JsonProtoReq, task *nfour.Task) *BatchItemRes {
+	if item == nil {
+		return batchItemErr(nil, rpc.ErrMissingKey)
+	}
+	if item.Key == BatchKey {
+		return batchItemErr(item, nfour.NewStatusError(nfour.StatusBadRequest, "nested batch"))
+	}
+	res, err := router.HandleTask(item, task)
+	if err != nil {
+		return batchItemErr(item, err)
+	}
+	return newBatchItemRes(res)
+}
+
+func batchItemErr(item *JsonProtoReq, err error) *BatchItemRes {
+	key := ""
+	if item != nil {
+		key = item.Key
+	}
+	return &BatchItemRes{
+		Key:     key,
+		Status:  nfour.StatusOf(err),
+		Message: nfour.StatusMessageOf(err),
+	}
+}
+
+// SendBatch 把 reqs 作为一个批量请求发送，返回的结果与 reqs 一一对应，error 表示整个批量请求失败
+func SendBatch(client JsonClient, reqs []*JsonProtoReq, reqTimeout *duplex.ReqTimeout) ([]*BatchResult, error) {
+	items := make([]*BatchItemReq, len(reqs))
+	for i, req := range reqs {
+		items[i] = newBatchItemReq(req)
+	}
+	body, err := json.Marshal(&BatchReq{Items: items})
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.SendRequest(&JsonProtoReq{Key: BatchKey, Body: body}, reqTimeout)
+	if err != nil {
+		return nil, err
+	}
+	batch := &BatchRes{}
+	if err = res.Err(); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(res.Body, batch); err != nil {
+		return nil, err
+	}
+	if len(batch.Items) != len(reqs) {
+		return nil, ErrBatchMismatch
+	}
+	results := make([]*BatchResult, len(reqs))
+	for i, item := range batch.Items {
+		if item.Status != nfour.StatusOK {
+			results[i] = &BatchResult{Err: nfour.NewStatusError(item.Status, item.Message)}
+			continue
+		}
+		results[i] = &BatchResult{Res: &JsonProtoRes{Key: item.Key, Body: item.payload(), Error: item.Error}}
+	}
+	return results, nil
+}
+
+// Batcher 自动合并请求的客户端，它实现了 JsonClient，在 window 时间内发送的请求会被合并成一个批量请求，
+// 服务端需要调用 RegisterBatch。只有一个请求时直接发送，不使用批量请求
+type Batcher struct {
+	client     JsonClient
+	window     time.Duration
+	maxItems   int
+	reqTimeout *duplex.ReqTimeout
+
+	lock     sync.Mutex
+	pending  []*batchCall
+	gen      uint64
+	shutdown bool
+}
+
+type batchCall struct {
+	req *JsonProtoReq
+	ch  chan *BatchResult
+}
+
+// NewBatcher 构建 Batcher
+//
+// window 合并请求的时间窗口，从窗口内的第一个请求开始计时
+//
+// maxItems 窗口内的请求数达到 maxItems 时立即发送
+//
+// reqTimeout 批量请求的超时时间，SendRequest 传入的 reqTimeout 被忽略
+func NewBatcher(client JsonClient, window time.Duration, maxItems int, reqTimeout *duplex.ReqTimeout) *Batcher {
+	if maxItems <= 0 || maxItems > MaxBatchItems {
+		maxItems = MaxBatchItems
+	}
+	return &Batcher{
+		client:     client,
+		window:     window,
+		maxItems:   maxItems,
+		reqTimeout: reqTimeout,
+	}
+}
+
+// SendRequest 把请求加入当前窗口，等待批量响应中对应的结果
+func (b *Batcher) SendRequest(req *JsonProtoReq, reqTimeout *duplex.ReqTimeout) (*JsonProtoRes, error) {
+	call := &batchCall{req: req, ch: make(chan *BatchResult, 1)}
+	b.lock.Lock()
+	if b.shutdown {
+		b.lock.Unlock()
+		return nil, ErrBatcherShutdown
+	}
+	b.pending = append(b.pending, call)
+	var calls []*batchCall
+	if len(b.pending) >= b.maxItems {
+		calls = b.take()
+	} else if len(b.pending) == 1 {
+		gen := b.gen
+		time.AfterFunc(b.window, func() {
+			b.flush(gen)
+		})
+	}
+	b.lock.Unlock()
+	if calls != nil {
+		b.send(calls)
+	}
+	ret := <-call.ch
+	return ret.Res, ret.Err
+}
+
+// Shutdown 发送窗口内剩余的请求并关闭底层客户端
+func (b *Batcher) Shutdown(source string) {
+	b.lock.Lock()
+	b.shutdown = true
+	calls := b.take()
+	b.lock.Unlock()
+	if len(calls) > 0 {
+		b.send(calls)
+	}
+	b.client.Shutdown(source)
+}
+
+// flush 时间窗口结束，gen 不一致说明这个窗口的请求已经因为达到 maxItems 被发送了
+func (b *Batcher) flush(gen uint64) {
+	b.lock.Lock()
+	if gen != b.gen {
+		b.lock.Unlock()
+		return
+	}
+	calls := b.take()
+	b.lock.Unlock()
+	b.send(calls)
+}
+
+// take 取出当前窗口的请求并开始新的窗口，需要持有锁
+func (b *Batcher) take() []*batchCall {
+	calls := b.pending
+	b.pending = nil
+	b.gen++
+	return calls
+}
+
+func (b *Batcher) send(calls []*batchCall) {
+	if len(calls) == 1 {
+		res, err := b.client.SendRequest(calls[0].req, b.reqTimeout)
+		calls[0].ch <- &BatchResult{Res: res, Err: err}
+		return
+	}
+	reqs := make([]*JsonProtoReq, len(calls))
+	for i, call := range calls {
+		reqs[i] = call.req
+	}
+	results, err := SendBatch(b.client, reqs, b.reqTimeout)
+	for i, call := range calls {
+		if err != nil {
+			call.ch <- &BatchResult{Err: err}
+			continue
+		}
+		call.ch <- results[i]
+	}
+}
@@ -0,0 +1,204 @@
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rolandhe/saber/gocc"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/loopback"
+	"github.com/rolandhe/saber/nfour/rpc"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendBatch(t *testing.T) {
+	working, _, router := NewJsonRpcSrvWorking(testErrToRes)
+	if _, err := RegisterService(router, "echo", &echoService{}); err != nil {
+		t.Fatal(err)
+	}
+	RegisterBatch(router, gocc.NewDefaultExecutor(2))
+	client := NewJsonRpcClient(loopback.NewTrans(working, "test"))
+
+	results, err := SendBatch(client, []*JsonProtoReq{
+		{Key: "echo.Echo", Body: []byte(`{"msg":"a"}`)},
+		{Key: "echo.Upper", Body: []byte(`{"msg":"b"}`)},
+		{Key: "echo.Missing"},
+		{Key: BatchKey},
+		{Key: "echo.Upper", Body: []byte(`{}`)},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(results[0].Res.Body) != `{"msg":"a"}` || string(results[1].Res.Body) != `{"msg":"B"}` {
+		t.Fatalf("unexpected results %s %s", results[0].Res.Body, results[1].Res.Body)
+	}
+	if !errors.Is(results[2].Err, nfour.ErrNotFound) || !errors.Is(results[3].Err, nfour.ErrBadRequest) {
+		t.Fatalf("unexpected item errors %v %v", results[2].Err, results[3].Err)
+	}
+	if results[4].Err != nil || string(results[4].Res.Body) != `{"msg":"error:empty message"}` {
+		t.Fatalf("business error should be in body, got %+v", results[4])
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	working, _, router := NewJsonRpcSrvWorking(testErrToRes)
+	if _, err := RegisterService(router, "echo", &echoService{}); err != nil {
+		t.Fatal(err)
+	}
+	RegisterBatch(router, nil)
+	batcher := NewBatcher(NewJsonRpcClient(loopback.NewTrans(working, "test")), time.Millisecond*100, 3, nil)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := batcher.SendRequest(&JsonProtoReq{Key: "echo.Echo", Body: []byte(`{"msg":"x"}`)}, nil)
+			if err != nil || string(res.Body) != `{"msg":"x"}` {
+				t.Errorf("unexpected response %v %v", res, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, rs := range router.Stats().Routes {
+		if rs.Key == BatchKey && rs.Calls != 1 {
+			t.Fatalf("expect one batch call, got %d", rs.Calls)
+		}
+	}
+	batcher.Shutdown("test")
+	if _, err := batcher.SendRequest(&JsonProtoReq{Key: "echo.Echo"}, nil); err != ErrBatcherShutdown {
+		t.Fatalf("expect shutdown, got %v", err)
+	}
+}
+
+func TestBatchItemEncoding(t *testing.T) {
+	body, err := json.Marshal(&BatchReq{Items: []*BatchItemReq{
+		newBatchItemReq(&JsonProtoReq{Key: "echo.Echo", Body: []byte(`{"msg":"a"}`)}),
+		newBatchItemReq(&JsonProtoReq{Key: "str", Body: []byte(" plain text")}),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `"body":{"msg":"a"}`) {
+		t.Fatalf("json item should be embedded, got %s", body)
+	}
+
+	working, _, router := NewJsonRpcSrvWorking(testErrToRes)
+	router.Register("str", FactoryStringTypeHandleBiz(func(s string) (string, error) {
+		return s + " <ok>", nil
+	}))
+	RegisterBatch(router, nil)
+	results, err := SendBatch(NewJsonRpcClient(loopback.NewTrans(working, "test")), []*JsonProtoReq{
+		{Key: "str", Body: []byte(" plain text")},
+		{Key: "str", Body: []byte(`{"a": 1}`)},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(results[0].Res.Body) != " plain text <ok>" || string(results[1].Res.Body) != `{"a": 1} <ok>` {
+		t.Fatalf("item bodies changed: %q %q", results[0].Res.Body, results[1].Res.Body)
+	}
+}
+
+func TestBatchAdmission(t *testing.T) {
+	working, _, router := NewJsonRpcSrvWorking(testErrToRes)
+	var running, maxRunning atomic.Int32
+	router.Register("slow", func(req *JsonProtoReq) (*JsonProtoRes, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 20)
+		return &JsonProtoRes{Key: req.Key, Body: req.Body}, nil
+	})
+	conf := nfour.NewSrvConf(working, nil, 1)
+	conf.SemaWaitTime = 0
+	conf.Limiter = gocc.NewTokenBucketLimiter(0.001, 2)
+	RegisterBatchWithConf(router, conf, gocc.NewDefaultExecutor(4))
+	client := NewJsonRpcClient(loopback.NewTrans(working, "test"))
+
+	reqs := make([]*JsonProtoReq, 4)
+	for i := range reqs {
+		reqs[i] = &JsonProtoReq{Key: "slow", Body: []byte(`{}`)}
+	}
+	results, err := SendBatch(client, reqs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if results[i].Err != nil {
+			t.Fatalf("item %d should be admitted, got %v", i, results[i].Err)
+		}
+	}
+	// 第一个请求使用批量请求本身的许可，之后的两个请求用完了令牌
+	if !errors.Is(results[3].Err, nfour.NewStatusError(nfour.StatusOverloaded, "")) {
+		t.Fatalf("expect item rejected by rate limiter, got %v", results[3].Err)
+	}
+	// 一个服务端并发许可加上批量请求本身的许可
+	if m := maxRunning.Load(); m > 2 {
+		t.Fatalf("batch items exceed server concurrency: %d", m)
+	}
+}
+
+// 批量请求中超时的请求使用批量请求本身的服务端并发时，在业务处理函数返回之前一直占用该并发
+func TestBatchItemTimeoutHoldsServerSlot(t *testing.T) {
+	cases := []struct {
+		name     string
+		withConf bool
+		executor gocc.Executor
+	}{
+		{"sequential", false, nil},
+		{"parallel", false, gocc.NewDefaultExecutor(2)},
+		{"inline", true, gocc.NewDefaultExecutor(2)},
+	}
+	for _, c := range cases {
+		working, _, router := NewJsonRpcSrvWorking(testErrToRes)
+		block := make(chan struct{})
+		router.Register("slow", func(req *JsonProtoReq) (*JsonProtoRes, error) {
+			<-block
+			return &JsonProtoRes{Key: req.Key, Body: req.Body}, nil
+		}, rpc.WithTimeout(time.Millisecond*20))
+		conf := nfour.NewSrvConf(working, nil, 1)
+		conf.SemaWaitTime = 0
+		var batchConf *nfour.SrvConf
+		if c.withConf {
+			batchConf = conf
+		}
+		RegisterBatchWithConf(router, batchConf, c.executor)
+
+		body, _ := json.Marshal(&BatchReq{Items: []*BatchItemReq{{Key: "slow", Body: []byte(`{}`)}}})
+		payload, _ := NewClientCodec(JsonCodec).Encode(&JsonProtoReq{Key: BatchKey, Body: body})
+		// 与通信层相同，获取服务端并发后提交请求，写出响应后调用 Done
+		sema := conf.GetConcurrent()
+		sema.Acquire()
+		task := nfour.NewTask(payload, sema.Release)
+		buf, err := working(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := NewClientCodec(JsonCodec).Decode(buf)
+		if err != nil || !strings.Contains(string(res.Body), "timeout") {
+			t.Fatalf("%s: expect item timeout, got %s %v", c.name, buf, err)
+		}
+		task.Done()
+		if sema.TryAcquire() {
+			t.Fatalf("%s: server slot released while batch item is still running", c.name)
+		}
+		close(block)
+		deadline := time.Now().Add(time.Second)
+		for !sema.TryAcquire() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: server slot never released", c.name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// ErrMalformedEnvelope 信封数据无法解析
+var ErrMalformedEnvelope = errors.New("malformed envelope")
+
+// binaryCodec 请求格式为 key长度(uvarint) + key + body，body 占用剩余的全部数据；
+// 响应格式为 key长度(uvarint) + key + error长度(uvarint) + error + body，error 是json编码的 ResError，长度为0表示没有业务错误
+type binaryCodec struct {
+}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) ContentType() byte {
+	return ContentTypeBinary
+}
+
+func (binaryCodec) EncodeReq(req *JsonProtoReq) ([]byte, error) {
+	return binaryEncode(req.Key, req.Body), nil
+}
+
+func (binaryCodec) DecodeReq(payload []byte) (*JsonProtoReq, error) {
+	key, body, err := binaryDecode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &JsonProtoReq{Key: key, Body: body}, nil
+}
+
+func (binaryCodec) EncodeRes(res *JsonProtoRes) ([]byte, error) {
+	var errBuf []byte
+	if res.Error != nil {
+		var err error
+		if errBuf, err = json.Marshal(res.Error); err != nil {
+			return nil, err
+		}
+	}
+	head := binaryEncode(res.Key, nil)
+	buf := make([]byte, len(head), len(head)+binary.MaxVarintLen64+len(errBuf)+len(res.Body))
+	copy(buf, head)
+	buf = binary.AppendUvarint(buf, uint64(len(errBuf)))
+	buf = append(buf, errBuf...)
+	return append(buf, res.Body...), nil
+}
+
+func (binaryCodec) DecodeRes(payload []byte) (*JsonProtoRes, error) {
+	key, rest, err := binaryDecode(payload)
+	if err != nil {
+		return nil, err
+	}
+	errBuf, body, err := binaryDecode(rest)
+	if err != nil {
+		return nil, err
+	}
+	res := &JsonProtoRes{Key: key, Body: body}
+	if len(errBuf) > 0 {
+		res.Error = &ResError{}
+		if err = json.Unmarshal([]byte(errBuf), res.Error); err != nil {
+			return nil, ErrMalformedEnvelope
+		}
+	}
+	return res, nil
+}
+
+func binaryEncode(key string, body []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(key)+len(body))
+	n := binary.PutUvarint(buf, uint64(len(key)))
+	n += copy(buf[n:], key)
+	n += copy(buf[n:], body)
+	return buf[:n]
+}
+
+func binaryDecode(payload []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(payload)
+	if n <= 0 || l > uint64(len(payload)-n) {
+		return "", nil, ErrMalformedEnvelope
+	}
+	end := n + int(l)
+	return string(payload[n:end]), payload[end:], nil
+}
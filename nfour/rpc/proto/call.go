@@ -0,0 +1,86 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"time"
+)
+
+// Call 调用 key 对应的方法，req 被编码成json作为请求的 Body，响应的 Body 被解码成 V，响应携带业务错误时返回 *ResError
+func Call[T any, V any](client JsonClient, key string, req *T, reqTimeout *duplex.ReqTimeout) (*V, error) {
+	return CallContext[T, V](context.Background(), client, key, req, reqTimeout)
+}
+
+// CallContext 与 Call 相同，但请求受 ctx 控制，见 SendRequestContext
+func CallContext[T any, V any](ctx context.Context, client JsonClient, key string, req *T, reqTimeout *duplex.ReqTimeout) (*V, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := SendRequestContext(ctx, client, &JsonProtoReq{Key: key, Body: body}, reqTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err = res.Err(); err != nil {
+		return nil, err
+	}
+	v := new(V)
+	if err = json.Unmarshal(res.Body, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Method 绑定了客户端和方法名称的rpc方法，可以事先声明后多次调用
+//
+//	var getUser = proto.NewMethod[GetUserReq, User](client, "user.get")
+//	user, err := getUser.Call(&GetUserReq{Id: 1}, nil)
+type Method[T any, V any] struct {
+	client JsonClient
+	key    string
+}
+
+// NewMethod 构建 Method
+func NewMethod[T any, V any](client JsonClient, key string) *Method[T, V] {
+	return &Method[T, V]{client: client, key: key}
+}
+
+// Key 方法名称
+func (m *Method[T, V]) Key() string {
+	return m.key
+}
+
+// Call 同 Call
+func (m *Method[T, V]) Call(req *T, reqTimeout *duplex.ReqTimeout) (*V, error) {
+	return Call[T, V](m.client, m.key, req, reqTimeout)
+}
+
+// SendRequestContext 使用 ctx 控制请求：ctx 已经结束时直接返回 ctx.Err()，ctx 的截止时间作为 ReadTimeout 的上限。
+// client 实现了 ContextJsonClient 时等待响应的过程中也可以通过 ctx 取消，否则只使用截止时间
+func SendRequestContext(ctx context.Context, client JsonClient, req *JsonProtoReq, reqTimeout *duplex.ReqTimeout) (*JsonProtoRes, error) {
+	if cc, ok := client.(ContextJsonClient); ok {
+		return cc.SendRequestContext(ctx, req, reqTimeout)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		rt := duplex.ReqTimeout{}
+		if reqTimeout != nil {
+			rt = *reqTimeout
+		}
+		if rt.ReadTimeout <= 0 || rt.ReadTimeout > remaining {
+			rt.ReadTimeout = remaining
+		}
+		reqTimeout = &rt
+	}
+	return client.SendRequest(req, reqTimeout)
+}
@@ -0,0 +1,35 @@
+package proto
+
+import (
+	"errors"
+	"github.com/rolandhe/saber/nfour/loopback"
+	"testing"
+)
+
+func TestCallWithResError(t *testing.T) {
+	working, _, router := NewNegotiatedRpcSrvWorking(nil, JsonCodec, GobCodec, MsgpackCodec, BinaryCodec)
+	router.Register("echo.Echo", FactoryHandleBiz(func(req *echoReq) (*echoRes, error) {
+		switch req.Msg {
+		case "":
+			return nil, &ResError{Code: 1001, Message: "empty message"}
+		case "panic":
+			return nil, errors.New("unexpected")
+		}
+		return &echoRes{Msg: req.Msg}, nil
+	}))
+	trans := loopback.NewTrans(working, "test")
+	for _, codec := range []Codec{JsonCodec, GobCodec, MsgpackCodec, BinaryCodec} {
+		echo := NewMethod[echoReq, echoRes](NewRpcClient(codec, trans), "echo.Echo")
+		res, err := echo.Call(&echoReq{Msg: "hi"}, nil)
+		if err != nil || res.Msg != "hi" {
+			t.Fatalf("%s: unexpected result %v %v", codec.Name(), res, err)
+		}
+		var resErr *ResError
+		if _, err = echo.Call(&echoReq{}, nil); !errors.As(err, &resErr) || resErr.Code != 1001 || resErr.Message != "empty message" {
+			t.Fatalf("%s: expect business error, got %v", codec.Name(), err)
+		}
+		if _, err = echo.Call(&echoReq{Msg: "panic"}, nil); !errors.As(err, &resErr) || resErr.Code != 0 || resErr.Message != "unexpected" {
+			t.Fatalf("%s: expect unclassified error, got %v", codec.Name(), err)
+		}
+	}
+}
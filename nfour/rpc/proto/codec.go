@@ -0,0 +1,261 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/rpc"
+)
+
+// 内容类型，除json外，请求和响应数据的首字节是内容类型，之后是信封数据。json数据总是以'{'开始，不需要额外的前缀，兼容最初的json协议
+const (
+	ContentTypeJson    byte = '{'
+	ContentTypeGob     byte = 0x01
+	ContentTypeMsgpack byte = 0x02
+	ContentTypeBinary  byte = 0x03
+)
+
+// Codec 协议信封(JsonProtoReq/JsonProtoRes)与二进制之间的编解码。
+// 信封中的 Body 是业务对象编码后的数据，Codec 只负责信封本身，不同的 Codec 可以按服务选择，服务端也可以同时支持多种 Codec(见 NewNegotiatedRpcSrvWorking)
+type Codec interface {
+	// Name 编解码名称，用于日志
+	Name() string
+	// ContentType 内容类型，每个 Codec 的内容类型必须不同
+	ContentType() byte
+	// EncodeReq 客户端编码请求
+	EncodeReq(req *JsonProtoReq) ([]byte, error)
+	// DecodeReq 服务端解码请求
+	DecodeReq(payload []byte) (*JsonProtoReq, error)
+	// EncodeRes 服务端编码响应
+	EncodeRes(res *JsonProtoRes) ([]byte, error)
+	// DecodeRes 客户端解码响应
+	DecodeRes(payload []byte) (*JsonProtoRes, error)
+}
+
+var (
+	// JsonCodec json编码的信封，Body 会被编码成base64，兼容最初的json协议
+	JsonCodec Codec = jsonCodec{}
+	// GobCodec 使用 encoding/gob 编码的信封，适用于两端都是go的服务
+	GobCodec Codec = gobCodec{}
+	// MsgpackCodec msgpack编码的信封，格式为包含 key 和 body 两个字段的map，body 使用bin类型，响应有业务错误时增加 error 字段，便于其他语言的客户端接入
+	MsgpackCodec Codec = msgpackCodec{}
+	// BinaryCodec 紧凑的二进制信封，请求格式为 key长度(uvarint) + key + body，响应在 key 之后增加 error长度(uvarint) + error(json)，没有业务错误时长度为0
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// NewSrvCodec 把 Codec 转换为服务端需要的 rpc.SrvCodec，编解码的数据带有内容类型前缀
+func NewSrvCodec(codec Codec) rpc.SrvCodec[JsonProtoReq, JsonProtoRes] {
+	return &srvCodec{codec: codec}
+}
+
+// NewClientCodec 把 Codec 转换为客户端需要的 rpc.ClientCodec，编解码的数据带有内容类型前缀
+func NewClientCodec(codec Codec) rpc.ClientCodec[JsonProtoReq, JsonProtoRes] {
+	return &clientCodec{codec: codec}
+}
+
+// NewRpcSrvWorking 与 NewJsonRpcSrvWorking 相同，但信封使用 codec 编解码，其他内容类型的请求返回 nfour.StatusUnsupportedMedia
+func NewRpcSrvWorking(codec Codec, errToRes rpc.HandleErrorFunc[JsonProtoRes]) (nfour.WorkingFunc, nfour.HandleError, *rpc.SrvRouter[JsonProtoReq, JsonProtoRes]) {
+	return NewNegotiatedRpcSrvWorking(errToRes, codec)
+}
+
+// NewNegotiatedRpcSrvWorking 构建同时支持多种 Codec 的服务端，根据请求的内容类型选择 Codec，响应使用与请求相同的 Codec，
+// 不支持的内容类型返回 nfour.StatusUnsupportedMedia。codecs 中的第一个 Codec 用于编码 nfour.HandleError 的返回值。
+// errToRes 为nil时使用 ErrorToRes，codecs 为空时使用 JsonCodec。
+// 返回的 router 没有注册自省方法，需要时使用 RegisterIntrospection 注册
+func NewNegotiatedRpcSrvWorking(errToRes rpc.HandleErrorFunc[JsonProtoRes], codecs ...Codec) (nfour.WorkingFunc, nfour.HandleError, *rpc.SrvRouter[JsonProtoReq, JsonProtoRes]) {
+	return newRpcSrvWorking(nil, errToRes, codecs)
+}
+
+func newRpcSrvWorking(opts *JsonOptions, errToRes rpc.HandleErrorFunc[JsonProtoRes], codecs []Codec) (nfour.WorkingFunc, nfour.HandleError, *rpc.SrvRouter[JsonProtoReq, JsonProtoRes]) {
+	if errToRes == nil {
+		errToRes = ErrorToRes
+	}
+	if len(codecs) == 0 {
+		codecs = []Codec{JsonCodec}
+	}
+	srvCodecs := map[byte]rpc.SrvCodec[JsonProtoReq, JsonProtoRes]{}
+	for _, codec := range codecs {
+		srvCodecs[codec.ContentType()] = &srvCodec{codec: codec, opts: opts}
+		if codec.ContentType() == ContentTypeJson {
+			// 其他语言的json客户端可能以空白字符开始
+			for _, b := range []byte(" \t\r\n") {
+				srvCodecs[b] = srvCodecs[ContentTypeJson]
+			}
+		}
+	}
+	errCodec := srvCodecs[codecs[0].ContentType()]
+	heFunc := func(err error) []byte {
+		body, _ := errCodec.Encode(errToRes(err, nil))
+		return body
+	}
+	wf, router := rpc.NewNegotiatedRpcWorking[JsonProtoReq, JsonProtoRes](srvCodecs, jsonKeyExtractor, errToRes)
+	return wf, heFunc, router
+}
+
+// NewRpcClient 与 NewJsonRpcClient 相同，但信封使用 codec 编解码，codec 需要与服务端一致
+func NewRpcClient(codec Codec, trans rpc.Transport) JsonClient {
+	return NewRpcClientWithRetry(codec, nil, trans)
+}
+
+// NewRpcClientWithRetry 与 NewJsonRpcClientWithRetry 相同，但信封使用 codec 编解码
+func NewRpcClientWithRetry(codec Codec, policy *rpc.RetryPolicy, trans ...rpc.Transport) JsonClient {
+	return rpc.NewMultiTransClient[JsonProtoReq, JsonProtoRes](NewClientCodec(codec), trans...).
+		WithKeyExtractor(jsonKeyExtractor).
+		WithRetryPolicy(policy)
+}
+
+type srvCodec struct {
+	codec Codec
+	// opts 用于解码请求对象，随请求传递给 FactoryHandleBiz
+	opts *JsonOptions
+}
+
+func (c *srvCodec) Decode(payload []byte) (*JsonProtoReq, error) {
+	envelope, err := unframe(c.codec, payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.codec.DecodeReq(envelope)
+	if err != nil {
+		return nil, err
+	}
+	req.jsonOpts = c.opts
+	return req, nil
+}
+
+func (c *srvCodec) Encode(res *JsonProtoRes) ([]byte, error) {
+	envelope, err := c.codec.EncodeRes(res)
+	if err != nil {
+		return nil, err
+	}
+	return frame(c.codec, envelope), nil
+}
+
+type clientCodec struct {
+	codec Codec
+}
+
+func (c *clientCodec) Decode(payload []byte) (*JsonProtoRes, error) {
+	envelope, err := unframe(c.codec, payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.codec.DecodeRes(envelope)
+}
+
+func (c *clientCodec) Encode(req *JsonProtoReq) ([]byte, error) {
+	envelope, err := c.codec.EncodeReq(req)
+	if err != nil {
+		return nil, err
+	}
+	return frame(c.codec, envelope), nil
+}
+
+// frame 在信封数据前增加内容类型，json数据本身以'{'开始，不需要增加
+func frame(codec Codec, envelope []byte) []byte {
+	if codec.ContentType() == ContentTypeJson {
+		return envelope
+	}
+	payload := make([]byte, len(envelope)+1)
+	payload[0] = codec.ContentType()
+	copy(payload[1:], envelope)
+	return payload
+}
+
+// unframe 校验并去除内容类型前缀
+func unframe(codec Codec, payload []byte) ([]byte, error) {
+	if codec.ContentType() == ContentTypeJson {
+		return payload, nil
+	}
+	if len(payload) == 0 || payload[0] != codec.ContentType() {
+		return nil, nfour.NewStatusError(nfour.StatusUnsupportedMedia, "expect "+codec.Name())
+	}
+	return payload[1:], nil
+}
+
+type jsonCodec struct {
+	opts *JsonOptions
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) ContentType() byte {
+	return ContentTypeJson
+}
+
+func (jsonCodec) EncodeReq(req *JsonProtoReq) ([]byte, error) {
+	return json.Marshal(req)
+}
+
+func (c jsonCodec) DecodeReq(payload []byte) (*JsonProtoReq, error) {
+	o := new(JsonProtoReq)
+	if err := c.opts.Unmarshal(payload, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (jsonCodec) EncodeRes(res *JsonProtoRes) ([]byte, error) {
+	return json.Marshal(res)
+}
+
+func (c jsonCodec) DecodeRes(payload []byte) (*JsonProtoRes, error) {
+	o := new(JsonProtoRes)
+	if err := c.opts.Unmarshal(payload, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+type gobCodec struct {
+}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) ContentType() byte {
+	return ContentTypeGob
+}
+
+func (gobCodec) EncodeReq(req *JsonProtoReq) ([]byte, error) {
+	return gobEncode(req)
+}
+
+func (gobCodec) DecodeReq(payload []byte) (*JsonProtoReq, error) {
+	o := new(JsonProtoReq)
+	if err := gobDecode(payload, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (gobCodec) EncodeRes(res *JsonProtoRes) ([]byte, error) {
+	return gobEncode(res)
+}
+
+func (gobCodec) DecodeRes(payload []byte) (*JsonProtoRes, error) {
+	o := new(JsonProtoRes)
+	if err := gobDecode(payload, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func gobEncode(v any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gobDecode(payload []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+}
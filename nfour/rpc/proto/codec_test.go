@@ -0,0 +1,109 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/loopback"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	bigBody := bytes.Repeat([]byte{0, 1, 2, 0xff}, 20000)
+	for _, codec := range []Codec{JsonCodec, GobCodec, MsgpackCodec, BinaryCodec} {
+		for _, body := range [][]byte{[]byte(`{"msg":"hi"}`), bigBody} {
+			payload, err := codec.EncodeReq(&JsonProtoReq{Key: "echo.Echo", Body: body})
+			if err != nil {
+				t.Fatalf("%s encode: %v", codec.Name(), err)
+			}
+			req, err := codec.DecodeReq(payload)
+			if err != nil || req.Key != "echo.Echo" || !bytes.Equal(req.Body, body) {
+				t.Fatalf("%s decode req: %v", codec.Name(), err)
+			}
+			payload, err = codec.EncodeRes(&JsonProtoRes{Key: "echo.Echo", Body: body})
+			if err != nil {
+				t.Fatalf("%s encode: %v", codec.Name(), err)
+			}
+			res, err := codec.DecodeRes(payload)
+			if err != nil || res.Key != "echo.Echo" || !bytes.Equal(res.Body, body) {
+				t.Fatalf("%s decode res: %v", codec.Name(), err)
+			}
+		}
+	}
+}
+
+func TestMalformedEnvelope(t *testing.T) {
+	for _, codec := range []Codec{MsgpackCodec, BinaryCodec} {
+		payload, _ := codec.EncodeReq(&JsonProtoReq{Key: "echo.Echo", Body: []byte("hi")})
+		if _, err := codec.DecodeReq(payload[:4]); err == nil {
+			t.Fatalf("%s should reject truncated payload", codec.Name())
+		}
+	}
+}
+
+// 未知字段被跳过，便于信封增加字段
+func TestMsgpackSkipsUnknownField(t *testing.T) {
+	payload := []byte{0x83, 0xa3, 'k', 'e', 'y', 0xa1, 'k', 0xa5, 'e', 'x', 't', 'r', 'a', 0x92, 0x01, 0xc3, 0xa4, 'b', 'o', 'd', 'y', 0xc4, 0x01, 'x'}
+	req, err := MsgpackCodec.DecodeReq(payload)
+	if err != nil || req.Key != "k" || string(req.Body) != "x" {
+		t.Fatalf("unexpected result %v %v", req, err)
+	}
+}
+
+func TestRpcClientWithBinaryCodec(t *testing.T) {
+	working, _, router := NewRpcSrvWorking(BinaryCodec, testErrToRes)
+	if _, err := RegisterService(router, "echo", &echoService{}); err != nil {
+		t.Fatal(err)
+	}
+	stub := &echoStub{}
+	if err := BindServiceStub(stub, NewRpcClient(BinaryCodec, loopback.NewTrans(working, "test")), "echo"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := stub.Echo(&echoReq{Msg: "hi"})
+	if err != nil || res.Msg != "hi" {
+		t.Fatalf("unexpected result %v %v", res, err)
+	}
+}
+
+func TestNegotiatedRpcSrvWorking(t *testing.T) {
+	working, _, router := NewNegotiatedRpcSrvWorking(testErrToRes, JsonCodec, MsgpackCodec, BinaryCodec)
+	if _, err := RegisterService(router, "echo", &echoService{}); err != nil {
+		t.Fatal(err)
+	}
+	trans := loopback.NewTrans(working, "test")
+	for _, codec := range []Codec{JsonCodec, MsgpackCodec, BinaryCodec} {
+		stub := &echoStub{}
+		if err := BindServiceStub(stub, NewRpcClient(codec, trans), "echo"); err != nil {
+			t.Fatal(err)
+		}
+		res, err := stub.Echo(&echoReq{Msg: codec.Name()})
+		if err != nil || res.Msg != codec.Name() {
+			t.Fatalf("%s unexpected result %v %v", codec.Name(), res, err)
+		}
+	}
+
+	stub := &echoStub{}
+	if err := BindServiceStub(stub, NewRpcClient(GobCodec, trans), "echo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stub.Echo(&echoReq{Msg: "gob"}); !errors.Is(err, nfour.ErrUnsupportedMedia) {
+		t.Fatalf("expect unsupported media, got %v", err)
+	}
+}
+
+func TestNegotiatedRpcSrvWorkingDefaultCodec(t *testing.T) {
+	working, errHandle, router := NewNegotiatedRpcSrvWorking(testErrToRes)
+	if _, err := RegisterService(router, "echo", &echoService{}); err != nil {
+		t.Fatal(err)
+	}
+	if body := errHandle(errors.New("boom")); len(body) == 0 || body[0] != '{' {
+		t.Fatalf("expect json error body, got %s", body)
+	}
+	stub := &echoStub{}
+	if err := BindServiceStub(stub, NewJsonRpcClient(loopback.NewTrans(working, "test")), "echo"); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := stub.Echo(&echoReq{Msg: "hi"}); err != nil || res.Msg != "hi" {
+		t.Fatalf("unexpected result %v %v", res, err)
+	}
+}
@@ -0,0 +1,155 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// ResError 响应中携带的业务错误，业务处理函数可以直接返回 *ResError 来指定错误码。
+// 通过 RegisterError/RegisterErrorType 注册的错误，客户端可以使用 errors.Is/errors.As 还原
+type ResError struct {
+	// Code 业务错误码，0表示未分类的错误
+	Code int `json:"code"`
+	// Message 错误信息
+	Message string `json:"message"`
+	// Details 错误的详细信息，json格式，RegisterErrorType 注册的错误类型被编码到这里
+	Details json.RawMessage `json:"details,omitempty"`
+}
+
+func (e *ResError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// Is 错误码是 RegisterError 注册的错误码时，与注册的错误比较；是 RegisterErrorType 注册的错误码时，
+// 还原出该类型的错误后使用 errors.Is 比较，比如 *ValidationError 满足 errors.Is(err, nfour.ErrBadRequest)
+func (e *ResError) Is(target error) bool {
+	entry := errorEntryOf(e.Code)
+	if entry == nil {
+		return false
+	}
+	if entry.sentinel != nil {
+		return entry.sentinel == target
+	}
+	typed, ok := e.typed(entry)
+	return ok && errors.Is(typed.Interface().(error), target)
+}
+
+// As 错误码是 RegisterErrorType 注册的错误码，并且 target 指向注册的错误类型时，把 Details 解码成该类型的错误
+func (e *ResError) As(target any) bool {
+	entry := errorEntryOf(e.Code)
+	if entry == nil || entry.typ == nil {
+		return false
+	}
+	tv := reflect.ValueOf(target)
+	if tv.Kind() != reflect.Pointer || tv.IsNil() || tv.Elem().Type() != entry.typ {
+		return false
+	}
+	typed, ok := e.typed(entry)
+	if !ok {
+		return false
+	}
+	tv.Elem().Set(typed)
+	return true
+}
+
+// typed 把 Details 解码成 entry 注册的错误类型
+func (e *ResError) typed(entry *errorEntry) (reflect.Value, bool) {
+	ev := reflect.New(entry.typ.Elem())
+	if len(e.Details) > 0 && json.Unmarshal(e.Details, ev.Interface()) != nil {
+		return ev, false
+	}
+	return ev, true
+}
+
+type errorEntry struct {
+	code     int
+	sentinel error
+	// typ 错误类型，总是指针类型
+	typ reflect.Type
+}
+
+var errorRegistry = struct {
+	sync.RWMutex
+	entries []*errorEntry
+	byCode  map[int]*errorEntry
+}{byCode: map[int]*errorEntry{}}
+
+// RegisterError 注册错误码与错误值的对应关系，一般在init中调用，服务端和客户端需要注册相同的对应关系。
+// 服务端的业务错误满足 errors.Is(err, sentinel) 时使用 code 作为错误码，客户端收到 code 时 errors.Is(err, sentinel) 成立
+func RegisterError(code int, sentinel error) {
+	registerErrorEntry(&errorEntry{code: code, sentinel: sentinel})
+}
+
+// RegisterErrorType 注册错误码与错误类型的对应关系，PT 是实现了 error 的结构体指针，一般在init中调用。
+// 服务端的业务错误满足 errors.As(err, &pt) 时使用 code 作为错误码，错误对象编码成json放到 ResError.Details，
+// 客户端收到 code 时可以使用 errors.As 还原出 PT 类型的错误
+func RegisterErrorType[T any, PT interface {
+	*T
+	error
+}](code int) {
+	registerErrorEntry(&errorEntry{code: code, typ: reflect.TypeOf(PT(nil))})
+}
+
+func registerErrorEntry(entry *errorEntry) {
+	errorRegistry.Lock()
+	defer errorRegistry.Unlock()
+	if old, ok := errorRegistry.byCode[entry.code]; ok {
+		for i, e := range errorRegistry.entries {
+			if e == old {
+				errorRegistry.entries = append(errorRegistry.entries[:i], errorRegistry.entries[i+1:]...)
+				break
+			}
+		}
+	}
+	errorRegistry.entries = append(errorRegistry.entries, entry)
+	errorRegistry.byCode[entry.code] = entry
+}
+
+func errorEntryOf(code int) *errorEntry {
+	errorRegistry.RLock()
+	defer errorRegistry.RUnlock()
+	return errorRegistry.byCode[code]
+}
+
+// NewResError 把 err 转换成 ResError，err 本身是 *ResError 时直接返回，否则按照注册的错误码转换，未注册的错误的错误码为0
+func NewResError(err error) *ResError {
+	var resErr *ResError
+	if errors.As(err, &resErr) {
+		return resErr
+	}
+	resErr = &ResError{Message: err.Error()}
+	errorRegistry.RLock()
+	defer errorRegistry.RUnlock()
+	for _, entry := range errorRegistry.entries {
+		if entry.sentinel != nil {
+			if errors.Is(err, entry.sentinel) {
+				resErr.Code = entry.code
+				return resErr
+			}
+			continue
+		}
+		target := reflect.New(entry.typ)
+		if errors.As(err, target.Interface()) {
+			resErr.Code = entry.code
+			resErr.Details, _ = json.Marshal(target.Elem().Interface())
+			return resErr
+		}
+	}
+	return resErr
+}
+
+// ErrorToRes 缺省的 rpc.HandleErrorFunc，使用 NewResError 把业务处理函数返回的错误转换成 JsonProtoRes.Error，客户端可以据此区分业务错误和正常响应。
+// 构建服务端时 errToRes 为nil则使用该函数
+func ErrorToRes(err error, interfaceName any) *JsonProtoRes {
+	res := &JsonProtoRes{Error: NewResError(err)}
+	if interfaceName != nil {
+		res.Key = fmt.Sprint(interfaceName)
+	}
+	return res
+}
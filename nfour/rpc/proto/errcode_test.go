@@ -0,0 +1,49 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rolandhe/saber/nfour/loopback"
+	"testing"
+)
+
+var errTestNotFound = errors.New("user not found")
+
+type testQuotaError struct {
+	Limit int `json:"limit"`
+}
+
+func (e *testQuotaError) Error() string {
+	return fmt.Sprintf("exceed quota %d", e.Limit)
+}
+
+func TestResErrorRegistry(t *testing.T) {
+	RegisterError(9001, errTestNotFound)
+	RegisterErrorType[testQuotaError](9002)
+
+	working, _, router := NewNegotiatedRpcSrvWorking(nil, JsonCodec, MsgpackCodec, BinaryCodec)
+	router.Register("user.Get", FactoryHandleBiz(func(req *echoReq) (*echoRes, error) {
+		if req.Msg == "quota" {
+			return nil, fmt.Errorf("get user: %w", &testQuotaError{Limit: 10})
+		}
+		return nil, fmt.Errorf("get user %s: %w", req.Msg, errTestNotFound)
+	}))
+	trans := loopback.NewTrans(working, "test")
+	for _, codec := range []Codec{JsonCodec, MsgpackCodec, BinaryCodec} {
+		get := NewMethod[echoReq, echoRes](NewRpcClient(codec, trans), "user.Get")
+		_, err := get.Call(&echoReq{Msg: "tom"}, nil)
+		if !errors.Is(err, errTestNotFound) {
+			t.Fatalf("%s: expect registered sentinel, got %v", codec.Name(), err)
+		}
+		var resErr *ResError
+		if !errors.As(err, &resErr) || resErr.Code != 9001 || resErr.Message != "get user tom: user not found" {
+			t.Fatalf("%s: unexpected res error %v", codec.Name(), err)
+		}
+
+		_, err = get.Call(&echoReq{Msg: "quota"}, nil)
+		var quotaErr *testQuotaError
+		if !errors.As(err, &quotaErr) || quotaErr.Limit != 10 || errors.Is(err, errTestNotFound) {
+			t.Fatalf("%s: expect registered error type, got %v", codec.Name(), err)
+		}
+	}
+}
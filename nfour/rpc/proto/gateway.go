@@ -0,0 +1,171 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/rpc"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// GatewayConf http网关的设置
+type GatewayConf struct {
+	// Prefix url路径前缀，比如 /rpc/，请求路径去掉前缀后是rpc方法名称
+	Prefix string
+	// JsonOptions 解码请求对象使用的选项，一般与 NewRpcSrvWorkingWithOptions 的设置相同
+	JsonOptions *JsonOptions
+	// MaxBodySize 请求数据的最大字节数，0表示使用 nfour.MaxPayloadLength
+	MaxBodySize int64
+	// ErrorStatus 业务错误对应的http状态码，nil表示使用业务错误的帧状态码对应的http状态码(见 nfour.StatusOf 和 HttpStatusOf)，
+	// 比如校验失败400、执行超时504、其他错误500。HandleErrorFunc 没有设置 JsonProtoRes.Error 时 resErr 由 NewResError 转换得到
+	ErrorStatus func(resErr *ResError) int
+	// SrvConf 不为nil时http请求与nfour协议的请求一样经过服务端的准入控制：先获取 SrvConf 的限流许可，再获取并发许可(最多等待 SemaWaitTime)，
+	// 被拒绝时返回503。一般是启动服务使用的 nfour.SrvConf，这样http请求和nfour请求共享服务端的容量
+	SrvConf *nfour.SrvConf
+}
+
+// gatewayError http网关的错误响应，与 JsonProtoRes 的 error 字段格式相同
+type gatewayError struct {
+	Error *ResError `json:"error"`
+}
+
+// NewGateway 构建 http.Handler，把 POST /{key} 请求转换成 JsonProtoReq 交给 router 处理，http请求的body是请求对象的json，
+// 成功时响应的body是 JsonProtoRes.Body，是json时 Content-Type 为 application/json，否则由 net/http 探测；
+// 失败时响应的body是 {"error": {"code": 0, "message": ""}}，HandleErrorFunc 把业务错误编码到 Body 时使用该 Body，http状态码见 HttpStatusOf 和 GatewayConf.ErrorStatus。
+// 同一个 router 可以同时通过nfour协议和http访问，不需要重复注册方法，http请求不使用响应缓存和请求合并
+func NewGateway(router *rpc.SrvRouter[JsonProtoReq, JsonProtoRes], conf *GatewayConf) http.Handler {
+	if conf == nil {
+		conf = &GatewayConf{}
+	}
+	return &gateway{router: router, conf: conf}
+}
+
+type gateway struct {
+	router *rpc.SrvRouter[JsonProtoReq, JsonProtoRes]
+	conf   *GatewayConf
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeGatewayError(w, http.StatusMethodNotAllowed, &ResError{Message: "method not allowed"})
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, g.conf.Prefix), "/")
+	maxSize := g.conf.MaxBodySize
+	if maxSize <= 0 {
+		maxSize = int64(nfour.MaxPayloadLength)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeGatewayError(w, http.StatusRequestEntityTooLarge, &ResError{Message: err.Error()})
+			return
+		}
+		writeGatewayError(w, http.StatusBadRequest, &ResError{Message: err.Error()})
+		return
+	}
+
+	task, err := g.admit(body)
+	if err != nil {
+		writeGatewayError(w, http.StatusServiceUnavailable, &ResError{Message: err.Error()})
+		return
+	}
+	defer task.Done()
+
+	req := &JsonProtoReq{Key: key, Body: body, jsonOpts: g.conf.JsonOptions}
+	res, bizErr, err := g.router.Dispatch(req, task)
+	if err != nil {
+		writeGatewayError(w, HttpStatusOf(nfour.StatusOf(err)), &ResError{Message: nfour.StatusMessageOf(err)})
+		return
+	}
+	if bizErr == nil && res.Error == nil {
+		writeGatewayBody(w, http.StatusOK, res.Body)
+		return
+	}
+	code := g.errorStatus(bizErr, res.Error)
+	if res.Error != nil {
+		writeGatewayError(w, code, res.Error)
+		return
+	}
+	// HandleErrorFunc 把业务错误编码到了 Body，保持服务原有的错误格式
+	writeGatewayBody(w, code, res.Body)
+}
+
+// admit 获取 GatewayConf.SrvConf 的限流和并发许可，返回的 Task 在请求结束后调用 Done 释放并发
+func (g *gateway) admit(body []byte) (*nfour.Task, error) {
+	conf := g.conf.SrvConf
+	if conf == nil {
+		return nil, nil
+	}
+	if !conf.AdmitRate() {
+		return nil, nfour.ErrRejectedRateLimit
+	}
+	if !conf.GetConcurrent().AcquireTimeout(conf.SemaWaitTime) {
+		return nil, nfour.ErrRejectedConcurrent
+	}
+	return nfour.NewTask(body, conf.GetConcurrent().Release), nil
+}
+
+// errorStatus 业务错误对应的http状态码，bizErr 为nil说明 res.Error 是业务处理函数正常返回的
+func (g *gateway) errorStatus(bizErr error, resErr *ResError) int {
+	if g.conf.ErrorStatus != nil {
+		if resErr == nil {
+			resErr = NewResError(bizErr)
+		}
+		return g.conf.ErrorStatus(resErr)
+	}
+	if bizErr == nil {
+		return DefaultErrorStatus(resErr)
+	}
+	return HttpStatusOf(nfour.StatusOf(bizErr))
+}
+
+func writeGatewayBody(w http.ResponseWriter, code int, body []byte) {
+	if json.Valid(body) {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func writeGatewayError(w http.ResponseWriter, code int, resErr *ResError) {
+	body, _ := json.Marshal(&gatewayError{Error: resErr})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// HttpStatusOf 帧状态码对应的http状态码
+func HttpStatusOf(status nfour.Status) int {
+	switch status {
+	case nfour.StatusOK:
+		return http.StatusOK
+	case nfour.StatusOverloaded:
+		return http.StatusServiceUnavailable
+	case nfour.StatusBadRequest:
+		return http.StatusBadRequest
+	case nfour.StatusNotFound:
+		return http.StatusNotFound
+	case nfour.StatusDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case nfour.StatusUnsupportedMedia:
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusInternalServerError
+}
+
+// DefaultErrorStatus 只根据错误码判断的业务错误http状态码，请求校验失败(CodeValidation)返回400，其他业务错误返回500，
+// 用于业务处理函数直接返回 JsonProtoRes.Error 的响应
+func DefaultErrorStatus(resErr *ResError) int {
+	if resErr.Code == CodeValidation {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,132 @@
+package proto
+
+import (
+	"encoding/json"
+	"github.com/rolandhe/saber/gocc"
+	"github.com/rolandhe/saber/nfour"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGateway(t *testing.T) {
+	_, _, router := NewJsonRpcSrvWorking(nil)
+	if _, err := RegisterService(router, "echo", &echoService{}); err != nil {
+		t.Fatal(err)
+	}
+	router.Register("order.Create", FactoryHandleBiz(func(req *testOrder) (*echoRes, error) {
+		return &echoRes{Msg: req.Id}, nil
+	}))
+	srv := httptest.NewServer(NewGateway(router, &GatewayConf{Prefix: "/rpc/", MaxBodySize: 64}))
+	defer srv.Close()
+
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		expect string
+	}{
+		{http.MethodPost, "/rpc/echo.Upper", `{"msg":"hi"}`, http.StatusOK, `{"msg":"HI"}`},
+		{http.MethodPost, "/rpc/echo.Upper", `{}`, http.StatusInternalServerError, "empty message"},
+		{http.MethodPost, "/rpc/order.Create", `{"id":"1"}`, http.StatusBadRequest, "buyer"},
+		{http.MethodPost, "/rpc/echo.Missing", `{}`, http.StatusNotFound, "unknown rpc key"},
+		{http.MethodPost, "/rpc/", `{}`, http.StatusBadRequest, "missing rpc key"},
+		{http.MethodPost, "/rpc/echo.Echo", `{"msg":"` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge, "too large"},
+		{http.MethodGet, "/rpc/echo.Echo", ``, http.StatusMethodNotAllowed, "not allowed"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader(c.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw json.RawMessage
+		json.NewDecoder(resp.Body).Decode(&raw)
+		resp.Body.Close()
+		if resp.StatusCode != c.code || !strings.Contains(string(raw), c.expect) {
+			t.Fatalf("%s %s: unexpected response %d %s", c.method, c.path, resp.StatusCode, raw)
+		}
+	}
+}
+
+func gatewayPost(t *testing.T, url string, body string) (*http.Response, string) {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, _ := io.ReadAll(resp.Body)
+	return resp, string(buf)
+}
+
+func TestGatewayCustomErrorAndContentType(t *testing.T) {
+	_, _, router := NewJsonRpcSrvWorking(testErrToRes)
+	if _, err := RegisterService(router, "echo", &echoService{}); err != nil {
+		t.Fatal(err)
+	}
+	router.Register("str", FactoryStringTypeHandleBiz(func(s string) (string, error) {
+		return "hello " + s, nil
+	}))
+	srv := httptest.NewServer(NewGateway(router, nil))
+	defer srv.Close()
+
+	// testErrToRes 把业务错误编码到 Body
+	resp, body := gatewayPost(t, srv.URL+"/echo.Upper", `{}`)
+	if resp.StatusCode != http.StatusInternalServerError || body != `{"msg":"error:empty message"}` {
+		t.Fatalf("unexpected error response %d %s", resp.StatusCode, body)
+	}
+	resp, body = gatewayPost(t, srv.URL+"/str", `tom`)
+	if resp.StatusCode != http.StatusOK || body != "hello tom" || strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		t.Fatalf("unexpected string response %d %s %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+}
+
+func TestGatewayAdmission(t *testing.T) {
+	working, _, router := NewJsonRpcSrvWorking(nil)
+	block := make(chan struct{})
+	router.Register("slow", func(req *JsonProtoReq) (*JsonProtoRes, error) {
+		<-block
+		return &JsonProtoRes{Key: req.Key, Body: []byte(`{}`)}, nil
+	})
+	conf := nfour.NewSrvConf(working, nil, 1)
+	conf.SemaWaitTime = 0
+	srv := httptest.NewServer(NewGateway(router, &GatewayConf{SrvConf: conf}))
+	defer srv.Close()
+
+	done := make(chan int)
+	go func() {
+		resp, err := http.Post(srv.URL+"/slow", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			done <- 0
+			return
+		}
+		resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	deadline := time.Now().Add(time.Second)
+	for router.Stats().InFlight != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("request never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if resp, body := gatewayPost(t, srv.URL+"/slow", `{}`); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expect 503 when server is full, got %d %s", resp.StatusCode, body)
+	}
+	close(block)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+
+	conf.Limiter = gocc.NewTokenBucketLimiter(0.001, 1)
+	if resp, _ := gatewayPost(t, srv.URL+"/slow", `{}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request should pass rate limiter, got %d", resp.StatusCode)
+	}
+	if resp, body := gatewayPost(t, srv.URL+"/slow", `{}`); resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "rate") {
+		t.Fatalf("expect 503 from rate limiter, got %d %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,84 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rolandhe/saber/nfour/duplex"
+	"github.com/rolandhe/saber/nfour/rpc"
+	"time"
+)
+
+// IntrospectionKey 内置的自省方法名称，返回已注册的方法及服务状态，可以用于健康检查
+const IntrospectionKey = "_nfour.introspect"
+
+// IntrospectionResult 自省方法的返回值
+type IntrospectionResult struct {
+	// Status 服务状态，能够响应时总是 ok
+	Status    string    `json:"status"`
+	StartTime time.Time `json:"startTime"`
+	// Uptime 运行时间，单位秒
+	Uptime   int64        `json:"uptime"`
+	InFlight int64        `json:"inFlight"`
+	NotFound int64        `json:"notFound"`
+	Methods  []MethodInfo `json:"methods"`
+}
+
+// MethodInfo 已注册方法的调用统计
+type MethodInfo struct {
+	Key         string `json:"key"`
+	Calls       int64  `json:"calls"`
+	Errors      int64  `json:"errors"`
+	CacheHits   int64  `json:"cacheHits,omitempty"`
+	CacheMisses int64  `json:"cacheMisses,omitempty"`
+	Coalesced   int64  `json:"coalesced,omitempty"`
+}
+
+// RegisterIntrospection 在 router 上注册 IntrospectionKey 方法，NewJsonRpcSrvWorking 等函数构建的 router 缺省不注册。
+// 自省方法会向所有客户端(包括通过 Gateway 访问的http客户端)暴露方法列表和服务状态，只应该在受信任的网络中注册，
+// 可以使用 router.Unregister(IntrospectionKey) 关闭
+func RegisterIntrospection(router *rpc.SrvRouter[JsonProtoReq, JsonProtoRes]) {
+	router.Register(IntrospectionKey, func(req *JsonProtoReq) (*JsonProtoRes, error) {
+		stats := router.Stats()
+		ret := &IntrospectionResult{
+			Status:    "ok",
+			StartTime: stats.StartTime,
+			Uptime:    int64(time.Since(stats.StartTime) / time.Second),
+			InFlight:  stats.InFlight,
+			NotFound:  stats.NotFound,
+		}
+		for _, rs := range stats.Routes {
+			ret.Methods = append(ret.Methods, MethodInfo{
+				Key:         fmt.Sprint(rs.Key),
+				Calls:       rs.Calls,
+				Errors:      rs.Errors,
+				CacheHits:   rs.CacheHits,
+				CacheMisses: rs.CacheMisses,
+				Coalesced:   rs.Coalesced,
+			})
+		}
+		body, err := json.Marshal(ret)
+		if err != nil {
+			return nil, err
+		}
+		return &JsonProtoRes{Key: req.Key, Body: body}, nil
+	})
+}
+
+// Introspect 调用服务端的自省方法
+func Introspect(client JsonClient, reqTimeout *duplex.ReqTimeout) (*IntrospectionResult, error) {
+	res, err := client.SendRequest(&JsonProtoReq{Key: IntrospectionKey}, reqTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err = res.Err(); err != nil {
+		return nil, err
+	}
+	ret := &IntrospectionResult{}
+	if err = json.Unmarshal(res.Body, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
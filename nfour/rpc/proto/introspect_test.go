@@ -0,0 +1,56 @@
+package proto
+
+import (
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/loopback"
+	"strings"
+	"testing"
+)
+
+func TestRouterIntrospection(t *testing.T) {
+	working, _, router := NewJsonRpcSrvWorking(testErrToRes)
+	if _, err := RegisterService(router, "echo", &echoService{}); err != nil {
+		t.Fatal(err)
+	}
+	client := NewJsonRpcClient(loopback.NewTrans(working, "test"))
+	if _, err := Introspect(client, nil); !errors.Is(err, nfour.ErrNotFound) {
+		t.Fatalf("introspection should not be registered by default, got %v", err)
+	}
+	RegisterIntrospection(router)
+
+	if _, err := client.SendRequest(&JsonProtoReq{Key: "echo.Echo", Body: []byte(`{"msg":"hi"}`)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.SendRequest(&JsonProtoReq{Key: "echo.Missing"}, nil)
+	if !errors.Is(err, nfour.ErrNotFound) || !strings.Contains(err.Error(), "unknown rpc key") {
+		t.Fatalf("expect unknown key, got %v", err)
+	}
+	if _, err = client.SendRequest(&JsonProtoReq{}, nil); !errors.Is(err, nfour.ErrBadRequest) {
+		t.Fatalf("expect missing key, got %v", err)
+	}
+
+	ret, err := Introspect(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Status != "ok" || ret.NotFound != 2 || len(ret.Methods) != 3 {
+		t.Fatalf("unexpected introspection %+v", ret)
+	}
+	if ret.Methods[1].Key != "echo.Echo" || ret.Methods[1].Calls != 1 {
+		t.Fatalf("unexpected method stats %+v", ret.Methods)
+	}
+
+	if !router.Unregister("echo.Upper") || router.Unregister("echo.Upper") {
+		t.Fatal("unexpected unregister result")
+	}
+	if keys := router.Keys(); len(keys) != 2 || keys[0] != IntrospectionKey {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	// 关闭自省
+	router.Unregister(IntrospectionKey)
+	if _, err = Introspect(client, nil); !errors.Is(err, nfour.ErrNotFound) {
+		t.Fatalf("expect introspection disabled, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/rpc"
+	"io"
+)
+
+var (
+	// ErrJsonTooLarge json数据超过 JsonOptions.MaxSize
+	ErrJsonTooLarge = nfour.NewStatusError(nfour.StatusBadRequest, "json too large")
+	// ErrJsonTooDeep json嵌套层数超过 JsonOptions.MaxDepth
+	ErrJsonTooDeep = nfour.NewStatusError(nfour.StatusBadRequest, "json too deep")
+)
+
+// JsonOptions json解码选项，用于尽早发现客户端与服务端的接口约定不一致，nil表示使用 json.Unmarshal 的缺省行为
+type JsonOptions struct {
+	// DisallowUnknownFields 存在结构体中没有的字段时返回错误
+	DisallowUnknownFields bool
+	// UseNumber 解码到 any 的数字使用 json.Number，而不是 float64
+	UseNumber bool
+	// MaxDepth 对象和数组的最大嵌套层数，0表示不限制
+	MaxDepth int
+	// MaxSize 请求对象json数据(JsonProtoReq.Body)的最大字节数，不包括信封，0表示不限制
+	MaxSize int
+}
+
+// envelope 解码json信封使用的选项，信封的大小由 nfour.MaxPayloadLength 限制
+func (o *JsonOptions) envelope() *JsonOptions {
+	if o == nil {
+		return nil
+	}
+	eo := *o
+	eo.MaxSize = 0
+	return &eo
+}
+
+// Unmarshal 按照选项解码 data，o 为nil时与 json.Unmarshal 相同
+func (o *JsonOptions) Unmarshal(data []byte, v any) error {
+	if o == nil {
+		return json.Unmarshal(data, v)
+	}
+	if o.MaxSize > 0 && len(data) > o.MaxSize {
+		return ErrJsonTooLarge
+	}
+	if o.MaxDepth > 0 {
+		if err := checkJsonDepth(data, o.MaxDepth); err != nil {
+			return err
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if o.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if o.UseNumber {
+		dec.UseNumber()
+	}
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	// 与 json.Unmarshal 一致，不允许json值之后还有其他数据
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("invalid data after top-level json value")
+	}
+	return nil
+}
+
+// checkJsonDepth 在解码之前检查嵌套层数，避免深度嵌套的数据消耗过多的资源
+func checkJsonDepth(data []byte, max int) error {
+	depth := 0
+	inStr, escaped := false, false
+	for _, c := range data {
+		if inStr {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inStr = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inStr = true
+		case '{', '[':
+			depth++
+			if depth > max {
+				return ErrJsonTooDeep
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+// NewJsonCodec 构建按照 opts 解码信封的json Codec，MaxSize 不用于信封，opts 为nil时与 JsonCodec 相同
+func NewJsonCodec(opts *JsonOptions) Codec {
+	return jsonCodec{opts: opts.envelope()}
+}
+
+// NewRpcSrvWorkingWithOptions 与 NewNegotiatedRpcSrvWorking 相同，但服务端使用 opts 解码json：
+// json信封、FactoryHandleBiz 和 RegisterService 注册的方法的请求对象、批量请求都按照 opts 解码，其他 Codec 的信封不受影响
+func NewRpcSrvWorkingWithOptions(opts *JsonOptions, errToRes rpc.HandleErrorFunc[JsonProtoRes], codecs ...Codec) (nfour.WorkingFunc, nfour.HandleError, *rpc.SrvRouter[JsonProtoReq, JsonProtoRes]) {
+	if len(codecs) == 0 {
+		codecs = []Codec{JsonCodec}
+	}
+	withOpts := make([]Codec, len(codecs))
+	for i, codec := range codecs {
+		if _, ok := codec.(jsonCodec); ok {
+			codec = NewJsonCodec(opts)
+		}
+		withOpts[i] = codec
+	}
+	return newRpcSrvWorking(opts, errToRes, withOpts)
+}
@@ -0,0 +1,49 @@
+package proto
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/rolandhe/saber/nfour/loopback"
+	"strings"
+	"testing"
+)
+
+type testAnyReq struct {
+	Msg   string `json:"msg"`
+	Value any    `json:"value"`
+}
+
+func TestJsonOptions(t *testing.T) {
+	opts := &JsonOptions{DisallowUnknownFields: true, UseNumber: true, MaxDepth: 3, MaxSize: 64}
+	working, _, router := NewRpcSrvWorkingWithOptions(opts, nil, JsonCodec, BinaryCodec)
+	router.Register("echo.Any", FactoryHandleBiz(func(req *testAnyReq) (*echoRes, error) {
+		if _, ok := req.Value.(json.Number); !ok {
+			return nil, errors.New("expect json.Number")
+		}
+		return &echoRes{Msg: req.Msg}, nil
+	}))
+	trans := loopback.NewTrans(working, "test")
+	for _, codec := range []Codec{JsonCodec, BinaryCodec} {
+		client := NewRpcClient(codec, trans)
+		send := func(body string) error {
+			res, err := client.SendRequest(&JsonProtoReq{Key: "echo.Any", Body: []byte(body)}, nil)
+			if err != nil {
+				return err
+			}
+			return res.Err()
+		}
+		if err := send(`{"msg":"hi","value":12345678901234567890}`); err != nil {
+			t.Fatalf("%s: unexpected error %v", codec.Name(), err)
+		}
+		for _, body := range []string{
+			`{"msg":"hi","value":1,"extra":true}`,
+			`{"msg":"hi","value":[[[1]]]}`,
+			`{"msg":"` + strings.Repeat("x", 64) + `","value":1}`,
+			`{"msg":"hi","value":1} {}`,
+		} {
+			if err := send(body); err == nil {
+				t.Fatalf("%s: expect error for %s", codec.Name(), body)
+			}
+		}
+	}
+}
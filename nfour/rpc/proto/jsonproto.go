@@ -2,7 +2,7 @@
 // Copyright 2023 The saber Authors. All rights reserved.
 
 // Package proto 协议层运行在rpc与tcp之间，它提供了业务对象与底层二进制之间的转换协议。
-// 当前实现的是json协议。
+// 请求和响应被封装成信封(JsonProtoReq/JsonProtoRes)，信封的编解码由 Codec 完成，内置json、gob、msgpack和紧凑二进制四种实现，缺省使用json。
 // 使用方式：
 //	func JsonRpcErrHandler(err error, interfaceName any) *proto.JsonProtoRes {
 //		ret := &Result[string]{
@@ -44,6 +44,7 @@
 package proto
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/rolandhe/saber/nfour"
 	"github.com/rolandhe/saber/nfour/duplex"
@@ -53,19 +54,9 @@ import (
 // json协议实现，业务对象被封装成可以打包的json对象，经过json转换后在网络上传输
 
 // NewJsonRpcSrvWorking 构建duplex层需要的 nfour.WorkingFunc, 编解码基于json实现
-// nfour.WorkingFunc 会被设置到 nfour.SrvConf中
+// nfour.WorkingFunc 会被设置到 nfour.SrvConf中，返回的 router 没有注册自省方法，见 RegisterIntrospection
 func NewJsonRpcSrvWorking(errToRes rpc.HandleErrorFunc[JsonProtoRes]) (nfour.WorkingFunc, nfour.HandleError, *rpc.SrvRouter[JsonProtoReq, JsonProtoRes]) {
-	codec := &jsonSerCodec[JsonProtoReq, JsonProtoRes]{}
-	kExtractor := func(req *JsonProtoReq) any {
-		return req.Key
-	}
-	heFunc := func(err error) []byte {
-		protoBuf := errToRes(err, nil)
-		body, _ := json.Marshal(protoBuf)
-		return body
-	}
-	wf, router := rpc.NewRpcWorking[JsonProtoReq, JsonProtoRes](codec, kExtractor, errToRes)
-	return wf, heFunc, router
+	return NewRpcSrvWorking(JsonCodec, errToRes)
 }
 
 // JsonClient 基于json编解码协议的客户端抽象
@@ -74,11 +65,32 @@ type JsonClient interface {
 	Shutdown(source string)
 }
 
+// ContextJsonClient 支持 context.Context 的 JsonClient，NewJsonRpcClient 等函数构建的客户端(rpc.Client)都实现了该接口，见 SendRequestContext
+type ContextJsonClient interface {
+	JsonClient
+	SendRequestContext(ctx context.Context, req *JsonProtoReq, reqTimeout *duplex.ReqTimeout) (*JsonProtoRes, error)
+}
+
 // NewJsonRpcClient 构建JsonClient客户端
-func NewJsonRpcClient(trans *duplex.Trans) JsonClient {
-	codec := &jsonClientCodec[JsonProtoReq, JsonProtoRes]{}
-	c := rpc.NewClient[JsonProtoReq, JsonProtoRes](codec, trans)
-	return c
+//
+// trans 底层的二进制传输，比如 duplex.Trans、simplex.Client、discovery.TransPool
+func NewJsonRpcClient(trans rpc.Transport) JsonClient {
+	return NewJsonRpcClientWithRetry(nil, trans)
+}
+
+// NewJsonRpcClientWithRetry 构建支持重试的JsonClient客户端，请求轮询的发送到多个 Transport，重试时切换 Transport
+//
+// policy 重试策略，幂等性根据 JsonProtoReq.Key 判断
+func NewJsonRpcClientWithRetry(policy *rpc.RetryPolicy, trans ...rpc.Transport) JsonClient {
+	return NewRpcClientWithRetry(JsonCodec, policy, trans...)
+}
+
+// jsonKeyExtractor 空的方法名称被当作缺少方法名称，服务端返回 rpc.ErrMissingKey
+func jsonKeyExtractor(req *JsonProtoReq) any {
+	if req.Key == "" {
+		return nil
+	}
+	return req.Key
 }
 
 // JsonProtoReq json协议封装请求
@@ -87,39 +99,78 @@ type JsonProtoReq struct {
 	Key string `json:"key"`
 	// 请求对象被编解码协议编码成二进制
 	Body []byte `json:"body"`
+
+	// jsonOpts 服务端解码请求对象使用的选项，由服务端的 Codec 设置
+	jsonOpts *JsonOptions
+}
+
+// JsonProtoRes json协议的响应对象
+type JsonProtoRes struct {
+	// rpc方法名称
+	Key string `json:"key"`
+	// 响应对象被编解码协议编码成二进制，Error 不为nil时没有意义
+	Body []byte `json:"body"`
+	// Error 业务错误，nil表示 Body 是正常的业务响应
+	Error *ResError `json:"error,omitempty"`
 }
 
-// JsonProtoRes json协议的响应对象，在json协议中req和res对象相同，但由于泛型的原因，二者命名需要不同，所以应用req的别名
-type JsonProtoRes JsonProtoReq
+// Err 以 error 返回业务错误，没有业务错误时返回nil
+func (res *JsonProtoRes) Err() error {
+	if res.Error == nil {
+		return nil
+	}
+	return res.Error
+}
 
 // JsonHandleBiz json协议的业务处理函数，用于server端，它被 FactoryHandleBiz 使用
 type JsonHandleBiz[T any, V any] func(tIns *T) (*V, error)
 
-// FactoryHandleBiz 包装JsonHandleBiz 为rpc.HandleBiz
+// FactoryHandleBiz 包装JsonHandleBiz 为rpc.HandleBiz，请求对象在调用 handle 之前使用 Validate 校验，校验失败返回 *ValidationError
 func FactoryHandleBiz[T any, V any](handle JsonHandleBiz[T, V]) rpc.HandleBiz[JsonProtoReq, JsonProtoRes] {
 	return func(req *JsonProtoReq) (*JsonProtoRes, error) {
 		tIns := new(T)
-		err := json.Unmarshal(req.Body, tIns)
-		if err != nil {
-			return nil, err
-		}
+		return handleJson(req, tIns, func() (any, error) {
+			return handle(tIns)
+		})
+	}
+}
 
-		v, err := handle(tIns)
-		if err != nil {
-			return nil, err
-		}
-		jv, err := json.Marshal(v)
-		if err != nil {
-			return nil, err
-		}
-		res := &JsonProtoRes{
-			Key:  req.Key,
-			Body: jv,
-		}
-		return res, nil
+// JsonHandleBizContext 与 JsonHandleBiz 类似，ctx 携带 rpc.WithTimeout 设置的截止时间，它被 FactoryHandleBizContext 使用
+type JsonHandleBizContext[T any, V any] func(ctx context.Context, tIns *T) (*V, error)
+
+// FactoryHandleBizContext 与 FactoryHandleBiz 类似，包装 JsonHandleBizContext 为 rpc.HandleBizContext，需要使用 rpc.SrvRouter.RegisterContext 注册
+func FactoryHandleBizContext[T any, V any](handle JsonHandleBizContext[T, V]) rpc.HandleBizContext[JsonProtoReq, JsonProtoRes] {
+	return func(ctx context.Context, req *JsonProtoReq) (*JsonProtoRes, error) {
+		tIns := new(T)
+		return handleJson(req, tIns, func() (any, error) {
+			return handle(ctx, tIns)
+		})
 	}
 }
 
+// handleJson 业务处理的公共流程：解码请求对象并使用 Validate 校验，调用 call 后把返回值编码成json响应。
+// FactoryHandleBiz、FactoryHandleBizContext、FactorySameTypeHandleBiz 和 RegisterService 共用
+func handleJson(req *JsonProtoReq, tIns any, call func() (any, error)) (*JsonProtoRes, error) {
+	if err := req.jsonOpts.Unmarshal(req.Body, tIns); err != nil {
+		return nil, err
+	}
+	if err := Validate(tIns); err != nil {
+		return nil, err
+	}
+	v, err := call()
+	if err != nil {
+		return nil, err
+	}
+	jv, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &JsonProtoRes{
+		Key:  req.Key,
+		Body: jv,
+	}, nil
+}
+
 // JsonSameTypeHandleBiz 与 JsonHandleBiz 类似，request和response采用相同的数据类型
 type JsonSameTypeHandleBiz[T any] func(tIns *T) (*T, error)
 
@@ -127,24 +178,9 @@ type JsonSameTypeHandleBiz[T any] func(tIns *T) (*T, error)
 func FactorySameTypeHandleBiz[T any](handle JsonSameTypeHandleBiz[T]) rpc.HandleBiz[JsonProtoReq, JsonProtoRes] {
 	return func(req *JsonProtoReq) (*JsonProtoRes, error) {
 		tIns := new(T)
-		err := json.Unmarshal(req.Body, tIns)
-		if err != nil {
-			return nil, err
-		}
-
-		v, err := handle(tIns)
-		if err != nil {
-			return nil, err
-		}
-		jv, err := json.Marshal(v)
-		if err != nil {
-			return nil, err
-		}
-		res := &JsonProtoRes{
-			Key:  req.Key,
-			Body: jv,
-		}
-		return res, nil
+		return handleJson(req, tIns, func() (any, error) {
+			return handle(tIns)
+		})
 	}
 }
 
@@ -166,9 +202,12 @@ func FactoryStringTypeHandleBiz(handle JsonStringTypeHandleBiz) rpc.HandleBiz[Js
 	}
 }
 
-// ParseJsonProtoRes 解析json协议数据，解析json数据为业务对象
+// ParseJsonProtoRes 解析json协议数据，解析json数据为业务对象，响应携带业务错误时返回该错误
 // factory 生成业务对象实例的回调
 func ParseJsonProtoRes[T any](res *JsonProtoRes, factory func() *T) (*T, error) {
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
 	tIns := factory()
 	if err := json.Unmarshal(res.Body, tIns); err != nil {
 		return nil, err
@@ -178,35 +217,8 @@ func ParseJsonProtoRes[T any](res *JsonProtoRes, factory func() *T) (*T, error)
 }
 
 func ParseStringValueJsonProtoRes(res *JsonProtoRes) (string, error) {
-	return string(res.Body), nil
-}
-
-type jsonClientCodec[REQ JsonProtoReq, RES JsonProtoRes] struct {
-}
-
-func (jc *jsonClientCodec[JsonProto, JsonProtoRes]) Decode(payload []byte) (*JsonProtoRes, error) {
-	o := new(JsonProtoRes)
-	if err := json.Unmarshal(payload, o); err != nil {
-		return nil, err
-	}
-	return o, nil
-}
-
-func (jc *jsonClientCodec[JsonProto, JsonProtoRes]) Encode(req *JsonProto) ([]byte, error) {
-	return json.Marshal(req)
-}
-
-type jsonSerCodec[REQ JsonProtoReq, RES JsonProtoRes] struct {
-}
-
-func (jc *jsonSerCodec[JsonProto, JsonProtoRes]) Decode(payload []byte) (*JsonProto, error) {
-	o := new(JsonProto)
-	if err := json.Unmarshal(payload, o); err != nil {
-		return nil, err
+	if err := res.Err(); err != nil {
+		return "", err
 	}
-	return o, nil
-}
-
-func (jc *jsonSerCodec[JsonProto, JsonProtoRes]) Encode(req *JsonProtoRes) ([]byte, error) {
-	return json.Marshal(req)
+	return string(res.Body), nil
 }
@@ -0,0 +1,381 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const maxSkipDepth = 32
+
+// msgpackCodec 信封被编码成msgpack的map: {"key": str, "body": bin}，响应有业务错误时增加 "error": {"code": int, "message": str, "details": bin}，
+// 解码时忽略未知的字段
+type msgpackCodec struct {
+}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) ContentType() byte {
+	return ContentTypeMsgpack
+}
+
+func (msgpackCodec) EncodeReq(req *JsonProtoReq) ([]byte, error) {
+	return msgpackEncode(req.Key, req.Body, nil), nil
+}
+
+func (msgpackCodec) DecodeReq(payload []byte) (*JsonProtoReq, error) {
+	res, err := msgpackDecode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &JsonProtoReq{Key: res.Key, Body: res.Body}, nil
+}
+
+func (msgpackCodec) EncodeRes(res *JsonProtoRes) ([]byte, error) {
+	return msgpackEncode(res.Key, res.Body, res.Error), nil
+}
+
+func (msgpackCodec) DecodeRes(payload []byte) (*JsonProtoRes, error) {
+	return msgpackDecode(payload)
+}
+
+func msgpackEncode(key string, body []byte, resErr *ResError) []byte {
+	w := &msgpackWriter{buf: make([]byte, 0, len(key)+len(body)+16)}
+	if resErr == nil {
+		w.buf = append(w.buf, 0x82)
+	} else {
+		w.buf = append(w.buf, 0x83)
+	}
+	w.writeStr("key")
+	w.writeStr(key)
+	w.writeStr("body")
+	w.writeBin(body)
+	if resErr != nil {
+		w.writeStr("error")
+		if len(resErr.Details) == 0 {
+			w.buf = append(w.buf, 0x82)
+		} else {
+			w.buf = append(w.buf, 0x83)
+		}
+		w.writeStr("code")
+		w.writeInt(int64(resErr.Code))
+		w.writeStr("message")
+		w.writeStr(resErr.Message)
+		if len(resErr.Details) > 0 {
+			w.writeStr("details")
+			w.writeBin(resErr.Details)
+		}
+	}
+	return w.buf
+}
+
+// msgpackDecode 解码请求或者响应，请求没有 error 字段
+func msgpackDecode(payload []byte) (*JsonProtoRes, error) {
+	r := &msgpackReader{buf: payload}
+	n, err := r.readMapLen()
+	if err != nil {
+		return nil, err
+	}
+	res := &JsonProtoRes{}
+	for i := 0; i < n; i++ {
+		field, err := r.readStr()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case "key":
+			res.Key, err = r.readStr()
+		case "body":
+			res.Body, err = r.readBin()
+		case "error":
+			res.Error, err = r.readResError()
+		default:
+			err = r.skip(0)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) writeStr(s string) {
+	l := len(s)
+	switch {
+	case l < 32:
+		w.buf = append(w.buf, 0xa0|byte(l))
+	case l <= math.MaxUint8:
+		w.buf = append(w.buf, 0xd9, byte(l))
+	case l <= math.MaxUint16:
+		w.buf = append(w.buf, 0xda)
+		w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(l))
+	default:
+		w.buf = append(w.buf, 0xdb)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(l))
+	}
+	w.buf = append(w.buf, s...)
+}
+
+func (w *msgpackWriter) writeBin(b []byte) {
+	if b == nil {
+		w.buf = append(w.buf, 0xc0)
+		return
+	}
+	l := len(b)
+	switch {
+	case l <= math.MaxUint8:
+		w.buf = append(w.buf, 0xc4, byte(l))
+	case l <= math.MaxUint16:
+		w.buf = append(w.buf, 0xc5)
+		w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(l))
+	default:
+		w.buf = append(w.buf, 0xc6)
+		w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(l))
+	}
+	w.buf = append(w.buf, b...)
+}
+
+func (w *msgpackWriter) writeInt(v int64) {
+	if v >= 0 && v <= 0x7f {
+		w.buf = append(w.buf, byte(v))
+		return
+	}
+	w.buf = append(w.buf, 0xd3)
+	w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(v))
+}
+
+type msgpackReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.buf)-r.pos {
+		return nil, ErrMalformedEnvelope
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *msgpackReader) readByte() (byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readUint 读取 n 个字节的大端无符号整数，n 为 1、2、4
+func (r *msgpackReader) readUint(n int) (int, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+func (r *msgpackReader) readMapLen() (int, error) {
+	t, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case t&0xf0 == 0x80:
+		return int(t & 0x0f), nil
+	case t == 0xde:
+		return r.readUint(2)
+	case t == 0xdf:
+		return r.readUint(4)
+	}
+	return 0, ErrMalformedEnvelope
+}
+
+func (r *msgpackReader) readInt() (int64, error) {
+	t, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if t <= 0x7f {
+		return int64(t), nil
+	}
+	if t >= 0xe0 {
+		return int64(int8(t)), nil
+	}
+	var b []byte
+	switch t {
+	case 0xcc, 0xd0:
+		b, err = r.next(1)
+	case 0xcd, 0xd1:
+		b, err = r.next(2)
+	case 0xce, 0xd2:
+		b, err = r.next(4)
+	case 0xcf, 0xd3:
+		b, err = r.next(8)
+	default:
+		return 0, ErrMalformedEnvelope
+	}
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	if t >= 0xd0 {
+		// 有符号整数需要按照实际长度做符号扩展
+		shift := 64 - 8*len(b)
+		return int64(u<<shift) >> shift, nil
+	}
+	return int64(u), nil
+}
+
+// readResError 读取响应中的 error 字段，nil 表示没有业务错误
+func (r *msgpackReader) readResError() (*ResError, error) {
+	if r.pos < len(r.buf) && r.buf[r.pos] == 0xc0 {
+		r.pos++
+		return nil, nil
+	}
+	n, err := r.readMapLen()
+	if err != nil {
+		return nil, err
+	}
+	resErr := &ResError{}
+	for i := 0; i < n; i++ {
+		field, err := r.readStr()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case "code":
+			var code int64
+			code, err = r.readInt()
+			resErr.Code = int(code)
+		case "message":
+			resErr.Message, err = r.readStr()
+		case "details":
+			resErr.Details, err = r.readBin()
+		default:
+			err = r.skip(0)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resErr, nil
+}
+
+func (r *msgpackReader) readStr() (string, error) {
+	b, err := r.readRaw()
+	return string(b), err
+}
+
+func (r *msgpackReader) readBin() ([]byte, error) {
+	return r.readRaw()
+}
+
+// readRaw 读取 str 或者 bin 类型的数据，nil 被当作空值
+func (r *msgpackReader) readRaw() ([]byte, error) {
+	t, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	var l int
+	switch {
+	case t == 0xc0:
+		return nil, nil
+	case t&0xe0 == 0xa0:
+		l = int(t & 0x1f)
+	case t == 0xd9 || t == 0xc4:
+		l, err = r.readUint(1)
+	case t == 0xda || t == 0xc5:
+		l, err = r.readUint(2)
+	case t == 0xdb || t == 0xc6:
+		l, err = r.readUint(4)
+	default:
+		return nil, ErrMalformedEnvelope
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.next(l)
+}
+
+// skip 跳过一个任意类型的值，嵌套超过 maxSkipDepth 层时认为数据非法
+func (r *msgpackReader) skip(depth int) error {
+	if depth > maxSkipDepth {
+		return ErrMalformedEnvelope
+	}
+	t, err := r.readByte()
+	if err != nil {
+		return err
+	}
+	size, count := 0, 0
+	switch {
+	case t <= 0x7f || t >= 0xe0 || t == 0xc0 || t == 0xc2 || t == 0xc3:
+	case t&0xe0 == 0xa0:
+		size = int(t & 0x1f)
+	case t&0xf0 == 0x90:
+		count = int(t & 0x0f)
+	case t&0xf0 == 0x80:
+		count = int(t&0x0f) * 2
+	case t == 0xcc || t == 0xd0:
+		size = 1
+	case t == 0xcd || t == 0xd1:
+		size = 2
+	case t == 0xce || t == 0xd2 || t == 0xca:
+		size = 4
+	case t == 0xcf || t == 0xd3 || t == 0xcb:
+		size = 8
+	case t == 0xd4 || t == 0xd5 || t == 0xd6 || t == 0xd7 || t == 0xd8:
+		size = 1 + 1<<(t-0xd4)
+	case t == 0xc4 || t == 0xd9:
+		size, err = r.readUint(1)
+	case t == 0xc5 || t == 0xda:
+		size, err = r.readUint(2)
+	case t == 0xc6 || t == 0xdb:
+		size, err = r.readUint(4)
+	case t == 0xc7 || t == 0xc8 || t == 0xc9:
+		size, err = r.readUint(1 << (t - 0xc7))
+		size++
+	case t == 0xdc:
+		count, err = r.readUint(2)
+	case t == 0xdd:
+		count, err = r.readUint(4)
+	case t == 0xde:
+		count, err = r.readUint(2)
+		count *= 2
+	case t == 0xdf:
+		count, err = r.readUint(4)
+		count *= 2
+	default:
+		return ErrMalformedEnvelope
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = r.next(size); err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		if err = r.skip(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
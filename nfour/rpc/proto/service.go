@@ -0,0 +1,178 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/rpc"
+	"reflect"
+)
+
+var (
+	// ErrNoServiceMethod 服务对象中没有符合要求的方法
+	ErrNoServiceMethod = errors.New("no service method")
+	// ErrInvalidStub 客户端桩对象不是指向struct的指针
+	ErrInvalidStub = errors.New("stub must be a pointer to struct")
+	// ErrInvalidService 服务对象为nil或者是nil指针
+	ErrInvalidService = errors.New("service must not be nil")
+
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// ServiceKey 服务方法的rpc方法名称，格式为 prefix.Method
+func ServiceKey(prefix string, method string) string {
+	return prefix + "." + method
+}
+
+// RegisterService 通过反射把 impl 的导出方法注册到 router，方法名称为 prefix.Method，返回注册的方法名称。
+// 支持以下两种形式的方法，其他形式的方法被忽略:
+//
+//	func (s *Svc) Method(req *T) (*V, error)
+//	func (s *Svc) Method(ctx context.Context, req *T) (*V, error)
+//
+// 请求和响应使用json编解码，请求使用 Validate 校验，与 FactoryHandleBiz 相同。opts 应用于所有的方法，
+// 带有 context.Context 的方法通过 ctx 获取 rpc.WithTimeout 设置的截止时间。impl 为nil或者nil指针时返回 ErrInvalidService
+func RegisterService(router *rpc.SrvRouter[JsonProtoReq, JsonProtoRes], prefix string, impl any, opts ...rpc.RouteOption) ([]string, error) {
+	v := reflect.ValueOf(impl)
+	if !v.IsValid() || (v.Kind() == reflect.Pointer && v.IsNil()) {
+		return nil, ErrInvalidService
+	}
+	t := v.Type()
+	var keys []string
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		shape, ok := parseMethodShape(v.Method(i).Type())
+		if !ok {
+			nfour.NFourLogger.Info("%s.%s is not a service method, ignore\n", t, m.Name)
+			continue
+		}
+		key := ServiceKey(prefix, m.Name)
+		router.RegisterContext(key, shape.handleBiz(v.Method(i)), opts...)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoServiceMethod, t)
+	}
+	return keys, nil
+}
+
+// BindServiceStub 通过反射为客户端桩对象的函数字段生成实现，每个函数字段对应服务端的一个方法，方法名称为 prefix.字段名，
+// 函数字段的形式与 RegisterService 支持的方法相同。带有 context.Context 的函数使用 SendRequestContext 发送请求，受 ctx 的截止时间和取消控制
+//
+//	type EchoStub struct {
+//		Echo func(req *EchoReq) (*EchoRes, error)
+//		Upper func(ctx context.Context, req *EchoReq) (*EchoRes, error)
+//	}
+//	stub := &EchoStub{}
+//	err := proto.BindServiceStub(stub, client, "echo")
+func BindServiceStub(stub any, client JsonClient, prefix string) error {
+	v := reflect.ValueOf(stub)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return ErrInvalidStub
+	}
+	v = v.Elem()
+	t := v.Type()
+	bound := 0
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Type.Kind() != reflect.Func {
+			continue
+		}
+		shape, ok := parseMethodShape(f.Type)
+		if !ok {
+			return fmt.Errorf("%s.%s is not a service method", t, f.Name)
+		}
+		v.Field(i).Set(reflect.MakeFunc(f.Type, shape.stubCall(client, ServiceKey(prefix, f.Name))))
+		bound++
+	}
+	if bound == 0 {
+		return fmt.Errorf("%w: %s", ErrNoServiceMethod, t)
+	}
+	return nil
+}
+
+// methodShape 服务方法的形式，func([ctx context.Context,] req *T) (*V, error)
+type methodShape struct {
+	withCtx bool
+	reqType reflect.Type
+	resType reflect.Type
+}
+
+func parseMethodShape(ft reflect.Type) (*methodShape, bool) {
+	if ft.NumOut() != 2 || ft.Out(0).Kind() != reflect.Pointer || ft.Out(1) != errorType {
+		return nil, false
+	}
+	shape := &methodShape{resType: ft.Out(0).Elem()}
+	switch ft.NumIn() {
+	case 1:
+	case 2:
+		if ft.In(0) != contextType {
+			return nil, false
+		}
+		shape.withCtx = true
+	default:
+		return nil, false
+	}
+	reqType := ft.In(ft.NumIn() - 1)
+	if reqType.Kind() != reflect.Pointer {
+		return nil, false
+	}
+	shape.reqType = reqType.Elem()
+	return shape, true
+}
+
+func (s *methodShape) handleBiz(method reflect.Value) rpc.HandleBizContext[JsonProtoReq, JsonProtoRes] {
+	return func(ctx context.Context, req *JsonProtoReq) (*JsonProtoRes, error) {
+		tIns := reflect.New(s.reqType)
+		return handleJson(req, tIns.Interface(), func() (any, error) {
+			in := []reflect.Value{tIns}
+			if s.withCtx {
+				in = []reflect.Value{reflect.ValueOf(ctx), tIns}
+			}
+			out := method.Call(in)
+			err, _ := out[1].Interface().(error)
+			return out[0].Interface(), err
+		})
+	}
+}
+
+func (s *methodShape) stubCall(client JsonClient, key string) func(args []reflect.Value) []reflect.Value {
+	return func(args []reflect.Value) []reflect.Value {
+		ctx := context.Background()
+		if s.withCtx {
+			ctx = args[0].Interface().(context.Context)
+		}
+		v, err := s.invoke(ctx, client, key, args[len(args)-1].Interface())
+		errValue := reflect.Zero(errorType)
+		if err != nil {
+			errValue = reflect.ValueOf(&err).Elem()
+		}
+		return []reflect.Value{v, errValue}
+	}
+}
+
+func (s *methodShape) invoke(ctx context.Context, client JsonClient, key string, req any) (reflect.Value, error) {
+	nilRes := reflect.Zero(reflect.PointerTo(s.resType))
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nilRes, err
+	}
+	res, err := SendRequestContext(ctx, client, &JsonProtoReq{Key: key, Body: body}, nil)
+	if err != nil {
+		return nilRes, err
+	}
+	if err = res.Err(); err != nil {
+		return nilRes, err
+	}
+	vIns := reflect.New(s.resType)
+	if err = json.Unmarshal(res.Body, vIns.Interface()); err != nil {
+		return nilRes, err
+	}
+	return vIns, nil
+}
@@ -0,0 +1,132 @@
+package proto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rolandhe/saber/nfour/loopback"
+	"github.com/rolandhe/saber/nfour/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+type echoReq struct {
+	Msg string `json:"msg"`
+}
+
+type echoRes struct {
+	Msg string `json:"msg"`
+}
+
+type echoService struct{}
+
+func (s *echoService) Echo(req *echoReq) (*echoRes, error) {
+	return &echoRes{Msg: req.Msg}, nil
+}
+
+func (s *echoService) Upper(ctx context.Context, req *echoReq) (*echoRes, error) {
+	if req.Msg == "" {
+		return nil, errors.New("empty message")
+	}
+	return &echoRes{Msg: strings.ToUpper(req.Msg)}, nil
+}
+
+func (s *echoService) Ignored(msg string) string {
+	return msg
+}
+
+type echoStub struct {
+	Echo  func(req *echoReq) (*echoRes, error)
+	Upper func(ctx context.Context, req *echoReq) (*echoRes, error)
+}
+
+func testErrToRes(err error, interfaceName any) *JsonProtoRes {
+	body, _ := json.Marshal(&echoRes{Msg: "error:" + err.Error()})
+	return &JsonProtoRes{Body: body}
+}
+
+func TestRegisterServiceAndStub(t *testing.T) {
+	working, _, router := NewJsonRpcSrvWorking(testErrToRes)
+	keys, err := RegisterService(router, "echo", &echoService{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	stub := &echoStub{}
+	if err = BindServiceStub(stub, NewJsonRpcClient(loopback.NewTrans(working, "test")), "echo"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := stub.Echo(&echoReq{Msg: "hi"})
+	if err != nil || res.Msg != "hi" {
+		t.Fatalf("unexpected result %v %v", res, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	res, err = stub.Upper(ctx, &echoReq{Msg: "hi"})
+	if err != nil || res.Msg != "HI" {
+		t.Fatalf("unexpected result %v %v", res, err)
+	}
+	res, err = stub.Upper(ctx, &echoReq{})
+	if err != nil || res.Msg != "error:empty message" {
+		t.Fatalf("unexpected result %v %v", res, err)
+	}
+}
+
+func TestRegisterServiceWithoutMethods(t *testing.T) {
+	_, _, router := NewJsonRpcSrvWorking(testErrToRes)
+	if _, err := RegisterService(router, "none", struct{}{}); !errors.Is(err, ErrNoServiceMethod) {
+		t.Fatalf("expect no service method, got %v", err)
+	}
+	for _, impl := range []any{nil, (*echoService)(nil)} {
+		if _, err := RegisterService(router, "nil", impl); !errors.Is(err, ErrInvalidService) {
+			t.Fatalf("expect invalid service, got %v", err)
+		}
+	}
+	if err := BindServiceStub(echoStub{}, nil, "echo"); !errors.Is(err, ErrInvalidStub) {
+		t.Fatalf("expect invalid stub, got %v", err)
+	}
+}
+
+type deadlineService struct{}
+
+func (s *deadlineService) Deadline(ctx context.Context, req *echoReq) (*echoRes, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, errors.New("no deadline")
+	}
+	return &echoRes{Msg: req.Msg}, nil
+}
+
+type deadlineStub struct {
+	Deadline func(ctx context.Context, req *echoReq) (*echoRes, error)
+}
+
+func TestServiceContext(t *testing.T) {
+	working, _, router := NewJsonRpcSrvWorking(testErrToRes)
+	if _, err := RegisterService(router, "dl", &deadlineService{}, rpc.WithTimeout(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	stub := &deadlineStub{}
+	if err := BindServiceStub(stub, NewJsonRpcClient(loopback.NewTrans(working, "test")), "dl"); err != nil {
+		t.Fatal(err)
+	}
+	// 路由的超时时间通过ctx传递给业务方法
+	res, err := stub.Deadline(context.Background(), &echoReq{Msg: "hi"})
+	if err != nil || res.Msg != "hi" {
+		t.Fatalf("unexpected result %v %v", res, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = stub.Deadline(ctx, &echoReq{Msg: "hi"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled, got %v", err)
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err = stub.Deadline(ctx, &echoReq{Msg: "hi"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect context.DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+// rpc implementation basing rpc abstraction
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rolandhe/saber/nfour"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CodeValidation 请求校验失败的错误码，客户端可以使用 errors.As 还原出 *ValidationError
+const CodeValidation = 400
+
+func init() {
+	RegisterErrorType[ValidationError](CodeValidation)
+}
+
+// Validator 请求对象实现该接口时，FactoryHandleBiz 在 validate 标签校验通过后调用 Validate 做自定义校验，只对请求对象本身生效
+type Validator interface {
+	Validate() error
+}
+
+// FieldError 单个字段的校验错误
+type FieldError struct {
+	// Field 字段路径，使用json名称，比如 items[0].name，Validator 返回的错误为空
+	Field string `json:"field"`
+	// Rule 未通过的规则，比如 required、min
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// ValidationError 请求校验失败，对应 nfour.StatusBadRequest，errors.Is(err, nfour.ErrBadRequest) 成立，
+// 客户端收到的 *ResError 同样成立，见 ResError.Is
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		if f.Field == "" {
+			msgs[i] = f.Message
+			continue
+		}
+		msgs[i] = f.Field + " " + f.Message
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+// Status 实现 nfour.StatusCarrier
+func (e *ValidationError) Status() nfour.Status {
+	return nfour.StatusBadRequest
+}
+
+// Is 支持 errors.Is(err, nfour.ErrBadRequest)
+func (e *ValidationError) Is(target error) bool {
+	return target == nfour.ErrBadRequest
+}
+
+// Validate 按照 validate 标签校验 v，然后调用 Validator.Validate，校验失败时返回 *ValidationError，标签不合法时返回其他错误。
+// 支持的规则，多个规则以逗号分隔，regex 必须是最后一个规则:
+//
+//	required   不能是零值，字符串、切片、map不能为空
+//	min=n      数值不小于n，字符串、切片、map的长度不小于n
+//	max=n      数值不大于n，字符串、切片、map的长度不大于n
+//	len=n      字符串、切片、map的长度等于n
+//	regex=expr 字符串匹配正则表达式
+//
+// 嵌套的结构体、结构体指针以及结构体切片会被递归校验，nil指针只校验 required
+func Validate(v any) error {
+	rv := reflect.ValueOf(v)
+	var fields []FieldError
+	if err := validateValue(rv, "", &fields); err != nil {
+		return err
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	validator, ok := v.(Validator)
+	if !ok {
+		return nil
+	}
+	err := validator.Validate()
+	if err == nil {
+		return nil
+	}
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return ve
+	}
+	return &ValidationError{Fields: []FieldError{{Rule: "validate", Message: err.Error()}}}
+}
+
+type validateRule struct {
+	name string
+	n    float64
+	re   *regexp.Regexp
+}
+
+type fieldRules struct {
+	index int
+	name  string
+	rules []*validateRule
+}
+
+type structRules struct {
+	fields []*fieldRules
+	err    error
+}
+
+var rulesCache sync.Map
+
+func rulesOf(t reflect.Type) *structRules {
+	if v, ok := rulesCache.Load(t); ok {
+		return v.(*structRules)
+	}
+	sr := &structRules{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		rules, err := parseRules(f.Tag.Get("validate"))
+		if err != nil {
+			sr.err = fmt.Errorf("%s.%s: %v", t.Name(), f.Name, err)
+			break
+		}
+		sr.fields = append(sr.fields, &fieldRules{index: i, name: jsonName(f), rules: rules})
+	}
+	v, _ := rulesCache.LoadOrStore(t, sr)
+	return v.(*structRules)
+}
+
+func parseRules(tag string) ([]*validateRule, error) {
+	var rules []*validateRule
+	for tag != "" {
+		var item string
+		if strings.HasPrefix(tag, "regex=") {
+			item, tag = tag, ""
+		} else if i := strings.IndexByte(tag, ','); i >= 0 {
+			item, tag = tag[:i], tag[i+1:]
+		} else {
+			item, tag = tag, ""
+		}
+		name, arg, _ := strings.Cut(item, "=")
+		rule := &validateRule{name: name}
+		var err error
+		switch name {
+		case "required":
+		case "min", "max", "len":
+			rule.n, err = strconv.ParseFloat(arg, 64)
+		case "regex":
+			rule.re, err = regexp.Compile(arg)
+		default:
+			err = fmt.Errorf("unknown validate rule %q", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return f.Name
+	}
+	return name
+}
+
+func validateValue(v reflect.Value, path string, fields *[]FieldError) error {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		sr := rulesOf(v.Type())
+		if sr.err != nil {
+			return sr.err
+		}
+		for _, fr := range sr.fields {
+			fv := v.Field(fr.index)
+			fp := fr.name
+			if path != "" {
+				fp = path + "." + fr.name
+			}
+			for _, rule := range fr.rules {
+				if msg := checkRule(rule, fv); msg != "" {
+					*fields = append(*fields, FieldError{Field: fp, Rule: rule.name, Message: msg})
+					break
+				}
+			}
+			if err := validateValue(fv, fp, fields); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		switch v.Type().Elem().Kind() {
+		case reflect.Struct, reflect.Pointer, reflect.Interface, reflect.Slice, reflect.Array:
+		default:
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkRule 校验单个规则，通过时返回空字符串，否则返回错误信息
+func checkRule(rule *validateRule, v reflect.Value) string {
+	if rule.name == "required" {
+		if isEmpty(v) {
+			return "is required"
+		}
+		return ""
+	}
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	switch rule.name {
+	case "min", "max":
+		n, isLen, ok := numberOf(v)
+		if !ok {
+			return ""
+		}
+		prefix := "must be"
+		if isLen {
+			prefix = "length must be"
+		}
+		if rule.name == "min" && n < rule.n {
+			return fmt.Sprintf("%s >= %v", prefix, rule.n)
+		}
+		if rule.name == "max" && n > rule.n {
+			return fmt.Sprintf("%s <= %v", prefix, rule.n)
+		}
+	case "len":
+		if n, isLen, ok := numberOf(v); ok && isLen && n != rule.n {
+			return fmt.Sprintf("length must be %v", rule.n)
+		}
+	case "regex":
+		if v.Kind() == reflect.String && !rule.re.MatchString(v.String()) {
+			return "must match " + rule.re.String()
+		}
+	}
+	return ""
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}
+
+// numberOf 数值返回其值，字符串、切片、map返回长度，isLen 表示返回的是长度
+func numberOf(v reflect.Value) (n float64, isLen bool, ok bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false, true
+	case reflect.String:
+		return float64(len([]rune(v.String()))), true, true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), true, true
+	}
+	return 0, false, false
+}
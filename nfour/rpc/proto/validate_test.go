@@ -0,0 +1,71 @@
+package proto
+
+import (
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/nfour/loopback"
+	"testing"
+)
+
+type testItem struct {
+	Sku   string `json:"sku" validate:"required,regex=^[A-Z]{2}-[0-9]+$"`
+	Count int    `json:"count" validate:"min=1,max=99"`
+}
+
+type testOrder struct {
+	Id    string      `json:"id" validate:"len=8"`
+	Buyer *string     `json:"buyer" validate:"required"`
+	Items []*testItem `json:"items" validate:"min=1"`
+	Note  string      `json:"note" validate:"max=4"`
+}
+
+func (o *testOrder) Validate() error {
+	if o.Note == "x" {
+		return errors.New("note x is reserved")
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	err := Validate(&testOrder{Id: "123", Items: []*testItem{{Sku: "AB-1", Count: 1}, {Sku: "ab", Count: 100}}, Note: "你好世界"})
+	var ve *ValidationError
+	if !errors.As(err, &ve) || !errors.Is(err, nfour.ErrBadRequest) {
+		t.Fatalf("expect validation error, got %v", err)
+	}
+	expect := []FieldError{
+		{Field: "id", Rule: "len"},
+		{Field: "buyer", Rule: "required"},
+		{Field: "items[1].sku", Rule: "regex"},
+		{Field: "items[1].count", Rule: "max"},
+	}
+	if len(ve.Fields) != len(expect) {
+		t.Fatalf("unexpected fields %+v", ve.Fields)
+	}
+	for i, f := range expect {
+		if ve.Fields[i].Field != f.Field || ve.Fields[i].Rule != f.Rule {
+			t.Fatalf("unexpected field %d %+v", i, ve.Fields[i])
+		}
+	}
+
+	buyer := "tom"
+	err = Validate(&testOrder{Id: "12345678", Buyer: &buyer, Items: []*testItem{{Sku: "AB-1", Count: 1}}, Note: "x"})
+	if !errors.As(err, &ve) || ve.Fields[0].Rule != "validate" {
+		t.Fatalf("expect Validate error, got %v", err)
+	}
+}
+
+func TestFactoryHandleBizValidation(t *testing.T) {
+	working, _, router := NewJsonRpcSrvWorking(nil)
+	router.Register("order.Create", FactoryHandleBiz(func(req *testOrder) (*echoRes, error) {
+		return &echoRes{Msg: req.Id}, nil
+	}))
+	create := NewMethod[testOrder, echoRes](NewJsonRpcClient(loopback.NewTrans(working, "test")), "order.Create")
+	_, err := create.Call(&testOrder{Id: "12345678"}, nil)
+	var ve *ValidationError
+	if !errors.As(err, &ve) || len(ve.Fields) != 2 || ve.Fields[1].Field != "items" {
+		t.Fatalf("expect validation error on client, got %v", err)
+	}
+	if !errors.Is(err, nfour.ErrBadRequest) {
+		t.Fatalf("validation error on client should be bad request, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+// rpc abstraction basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package rpc
+
+import (
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"time"
+)
+
+// RetryClass 描述一个错误是否可以重试
+type RetryClass int
+
+const (
+	// NotRetriable 不能重试
+	NotRetriable RetryClass = iota
+	// RetriableSafe 请求确定没有被服务端执行，任何请求都可以重试
+	RetriableSafe
+	// RetriableIdempotent 请求可能已经被服务端执行，只有幂等的请求才可以重试
+	RetriableIdempotent
+)
+
+// RetryPolicy 客户端的重试策略
+type RetryPolicy struct {
+	// MaxAttempts 最多的尝试次数，包括第一次请求，小于等于1表示不重试
+	MaxAttempts int
+	// Backoff 第 attempt 次重试前需要等待的时间，attempt从1开始，nil表示不等待立即重试。SendRequestContext 的 ctx 被取消时等待立即结束
+	Backoff func(attempt int) time.Duration
+	// Classify 判断错误是否可以重试，nil表示使用 DefaultRetryClassify
+	Classify func(err error) RetryClass
+	// Idempotent 根据方法名称判断请求是否幂等，方法名称由 Client.WithKeyExtractor 设置的提取工具提取，nil表示所有请求都不是幂等的
+	Idempotent func(key any) bool
+}
+
+// DefaultRetryClassify 缺省的错误分类:
+//
+// 超出并发(本地或者服务端过载)、Trans 已经关闭、熔断器打开时请求没有被执行，可以安全重试
+//
+// 请求执行超时或者等待响应时 Trans 被关闭，请求可能已经被执行，只有幂等请求可以重试
+func DefaultRetryClassify(err error) RetryClass {
+	switch {
+	case errors.Is(err, nfour.ErrTaskTimeout), errors.Is(err, nfour.ErrTransShutdownInFlight):
+		return RetriableIdempotent
+	case errors.Is(err, nfour.ExceedConcurrentError), errors.Is(err, nfour.ErrTransShutdown), errors.Is(err, nfour.ErrCircuitOpen):
+		return RetriableSafe
+	}
+	return NotRetriable
+}
+
+// ExponentialBackoff 指数退避，第n次重试等待 base * 2^(n-1)，最大不超过 max
+func ExponentialBackoff(base time.Duration, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// IdempotentKeys 指定幂等的方法名称列表，返回值可以设置到 RetryPolicy.Idempotent
+func IdempotentKeys(keys ...any) func(key any) bool {
+	set := make(map[any]struct{}, len(keys))
+	for _, k := range keys {
+		set[k] = struct{}{}
+	}
+	return func(key any) bool {
+		_, ok := set[key]
+		return ok
+	}
+}
+
+func (p *RetryPolicy) canRetry(err error, attempt int, key any) bool {
+	if attempt >= p.MaxAttempts {
+		return false
+	}
+	classify := p.Classify
+	if classify == nil {
+		classify = DefaultRetryClassify
+	}
+	switch classify(err) {
+	case RetriableSafe:
+		return true
+	case RetriableIdempotent:
+		return p.Idempotent != nil && p.Idempotent(key)
+	}
+	return false
+}
+
+// backoff 等待第 attempt 次重试前的退避时间，等待期间 cancel 被关闭时返回false
+func (p *RetryPolicy) backoff(attempt int, cancel <-chan struct{}) bool {
+	if p.Backoff == nil {
+		return !isClosed(cancel)
+	}
+	d := p.Backoff(attempt)
+	if d <= 0 {
+		return !isClosed(cancel)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
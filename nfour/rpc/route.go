@@ -0,0 +1,222 @@
+// rpc abstraction basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/rolandhe/saber/gocc"
+	"github.com/rolandhe/saber/nfour"
+	"sync/atomic"
+	"time"
+)
+
+// ErrHandlerTimeout 业务处理函数执行超过 WithTimeout 设置的时间，该错误会交给 HandleErrorFunc 转换成业务响应，
+// errors.Is(err, context.DeadlineExceeded) 同样成立
+var ErrHandlerTimeout = fmt.Errorf("rpc handler timeout, %w", context.DeadlineExceeded)
+
+// Priority 方法的优先级，用于两种准入控制：
+//   - SrvRouter.SetPriorityReserve 为 PriorityHigh 预留容量，服务繁忙时其他优先级的请求先被拒绝
+//   - SrvRouter.SetPriorityLimit 限制同一优先级的方法共享的并发上限
+type Priority uint8
+
+const (
+	// PriorityNormal 缺省优先级
+	PriorityNormal Priority = iota
+	// PriorityHigh 高优先级，比如简单的查询，可以使用 SrvRouter.SetPriorityReserve 预留的容量
+	PriorityHigh
+	// PriorityLow 低优先级，比如耗时的报表，一般需要设置并发上限，避免占满服务端的并发
+	PriorityLow
+	priorityCount
+)
+
+// RouteOption 注册方法时的可选设置
+type RouteOption func(opts *routeOptions)
+
+type routeOptions struct {
+	concurrent gocc.Semaphore
+	semaWait   time.Duration
+	timeout    time.Duration
+	priority   Priority
+	cache      *respCache
+	coalescer  *coalescer
+}
+
+// WithMaxConcurrency 设置方法的最大并发数，到达最大并发后等待 wait 时间，仍然无法执行时返回 nfour.ErrRejectedConcurrent，
+// 以 nfour.StatusOverloaded 状态返回给客户端
+func WithMaxConcurrency(n uint, wait time.Duration) RouteOption {
+	return func(opts *routeOptions) {
+		opts.concurrent = gocc.NewDefaultSemaphore(n)
+		opts.semaWait = wait
+	}
+}
+
+// WithTimeout 设置方法的执行超时时间，超时后返回 ErrHandlerTimeout，并由 HandleErrorFunc 转换成业务响应。
+// RegisterContext 注册的业务处理函数可以通过 ctx 获取截止时间，超时后 ctx 被取消；超时的业务处理函数不会被中断，它占用的并发直到函数返回后才会释放
+func WithTimeout(d time.Duration) RouteOption {
+	return func(opts *routeOptions) {
+		opts.timeout = d
+	}
+}
+
+// WithPriority 设置方法的优先级
+func WithPriority(p Priority) RouteOption {
+	return func(opts *routeOptions) {
+		if p < priorityCount {
+			opts.priority = p
+		}
+	}
+}
+
+type route[REQ any, RES any] struct {
+	fn     HandleBizContext[REQ, RES]
+	opts   *routeOptions
+	calls  atomic.Int64
+	errors atomic.Int64
+}
+
+func newRoute[REQ any, RES any](fn HandleBizContext[REQ, RES], opts []RouteOption) *route[REQ, RES] {
+	ro := &routeOptions{}
+	for _, opt := range opts {
+		opt(ro)
+	}
+	return &route[REQ, RES]{fn: fn, opts: ro}
+}
+
+// priorityLimit 同一优先级方法共享的并发上限
+type priorityLimit struct {
+	concurrent gocc.Semaphore
+	wait       time.Duration
+}
+
+// priorityReserve SrvRouter 的总容量，其中 reserved 只能被 PriorityHigh 使用
+type priorityReserve struct {
+	shared   gocc.Semaphore
+	reserved gocc.Semaphore
+	wait     time.Duration
+}
+
+// acquire 返回获取到的信号量，无法获取时返回nil。PriorityHigh 先使用共享的容量，共享容量用完后等待预留的容量
+func (rv *priorityReserve) acquire(p Priority) gocc.Semaphore {
+	if p == PriorityHigh {
+		if rv.shared.TryAcquire() {
+			return rv.shared
+		}
+		if rv.reserved.AcquireTimeout(rv.wait) {
+			return rv.reserved
+		}
+		return nil
+	}
+	if rv.shared.AcquireTimeout(rv.wait) {
+		return rv.shared
+	}
+	return nil
+}
+
+type taskCtxKey struct{}
+
+// TaskOf 返回 ctx 中携带的 nfour.Task，即当前请求占用的服务端并发，RegisterContext 注册的业务处理函数可以使用。
+// 业务处理函数在其他goroutine中继续处理请求时(比如批量请求中的请求)，可以通过 nfour.Task.Hold 继续占用该并发直到处理结束。
+// 请求不是由通信层提交的(比如 SrvRouter.Handle)时返回nil，nil的 Task 可以安全的调用 Hold 和 Done
+func TaskOf(ctx context.Context) *nfour.Task {
+	task, _ := ctx.Value(taskCtxKey{}).(*nfour.Task)
+	return task
+}
+
+type handleResult[RES any] struct {
+	res *RES
+	err error
+}
+
+// SetPriorityLimit 设置优先级 p 的所有方法共享的最大并发数，到达上限后等待 wait 时间，仍然无法执行时返回 nfour.ErrRejectedConcurrent。
+// 比如限制 PriorityLow 的并发，耗时的低优先级方法就不会占满服务端的并发，影响其他方法
+func (r *SrvRouter[REQ, RES]) SetPriorityLimit(p Priority, maxInFlight uint, wait time.Duration) {
+	if p >= priorityCount {
+		return
+	}
+	r.priorityLimits[p].Store(&priorityLimit{gocc.NewDefaultSemaphore(maxInFlight), wait})
+}
+
+// SetPriorityReserve 设置 SrvRouter 的总容量 total，其中 reserved 个只能被 PriorityHigh 的方法使用，
+// 其他优先级的方法最多同时执行 total-reserved 个，到达上限后等待 wait 时间，仍然无法执行时返回 nfour.ErrRejectedConcurrent。
+// 服务繁忙时低优先级的请求被尽快拒绝，高优先级的请求仍然可以执行。
+// total 应小于 nfour.SrvConf 的并发数，否则服务端的并发先被占满，请求无法到达 SrvRouter；reserved 需要小于 total，否则设置被忽略
+func (r *SrvRouter[REQ, RES]) SetPriorityReserve(total uint, reserved uint, wait time.Duration) {
+	if reserved >= total {
+		nfour.NFourLogger.Info("invalid priority reserve %d of %d, ignored\n", reserved, total)
+		return
+	}
+	r.reserve.Store(&priorityReserve{
+		shared:   gocc.NewDefaultSemaphore(total - reserved),
+		reserved: gocc.NewDefaultSemaphore(reserved),
+		wait:     wait,
+	})
+}
+
+// acquire 依次获取总容量、优先级和方法的并发，返回的函数用于在业务处理函数返回后释放
+func (r *SrvRouter[REQ, RES]) acquire(rt *route[REQ, RES]) (func(), error) {
+	var releases []gocc.Semaphore
+	release := func() {
+		for _, sema := range releases {
+			sema.Release()
+		}
+	}
+	if rv := r.reserve.Load(); rv != nil {
+		sema := rv.acquire(rt.opts.priority)
+		if sema == nil {
+			return nil, nfour.ErrRejectedConcurrent
+		}
+		releases = append(releases, sema)
+	}
+	if limit := r.priorityLimits[rt.opts.priority].Load(); limit != nil {
+		if !limit.concurrent.AcquireTimeout(limit.wait) {
+			release()
+			return nil, nfour.ErrRejectedConcurrent
+		}
+		releases = append(releases, limit.concurrent)
+	}
+	if rt.opts.concurrent != nil {
+		if !rt.opts.concurrent.AcquireTimeout(rt.opts.semaWait) {
+			release()
+			return nil, nfour.ErrRejectedConcurrent
+		}
+		releases = append(releases, rt.opts.concurrent)
+	}
+	return release, nil
+}
+
+// call 执行业务处理函数，设置了超时时间时在独立的goroutine中执行。
+// 超时后业务处理函数仍在执行，因此通过 task.Hold 接管服务端的并发，直到业务处理函数返回才释放，避免服务端的实际并发超出限制
+func (r *SrvRouter[REQ, RES]) call(rt *route[REQ, RES], req *REQ, release func(), task *nfour.Task) (*RES, error) {
+	r.inFlight.Add(1)
+	done := func() {
+		r.inFlight.Add(-1)
+		release()
+	}
+	base := context.Background()
+	if task != nil {
+		base = context.WithValue(base, taskCtxKey{}, task)
+	}
+	if rt.opts.timeout <= 0 {
+		defer done()
+		return rt.fn(base, req)
+	}
+	// cancel 只在业务处理函数返回或者超时之后调用，因此 ctx.Done() 只表示超时
+	ctx, cancel := context.WithTimeout(base, rt.opts.timeout)
+	defer cancel()
+	ch := make(chan *handleResult[RES], 1)
+	finish := task.Hold()
+	go func() {
+		defer finish()
+		defer done()
+		res, err := rt.fn(ctx, req)
+		ch <- &handleResult[RES]{res, err}
+	}()
+	select {
+	case hr := <-ch:
+		return hr.res, hr.err
+	case <-ctx.Done():
+		return nil, ErrHandlerTimeout
+	}
+}
@@ -6,14 +6,63 @@
 package rpc
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"github.com/rolandhe/saber/nfour"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	badReqErr = errors.New("bad request")
-)
+// ErrMissingKey 请求中没有rpc方法名称，以 nfour.StatusBadRequest 状态返回给客户端
+var ErrMissingKey = nfour.NewStatusError(nfour.StatusBadRequest, "missing rpc key")
+
+// UnknownKeyError 请求的rpc方法没有注册，以 nfour.StatusNotFound 状态返回给客户端，errors.Is(err, nfour.ErrNotFound) 成立
+type UnknownKeyError struct {
+	Key any
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("unknown rpc key: %v", e.Key)
+}
+
+// Status 实现 nfour.StatusCarrier
+func (e *UnknownKeyError) Status() nfour.Status {
+	return nfour.StatusNotFound
+}
+
+// Is 支持 errors.Is(err, nfour.ErrNotFound)
+func (e *UnknownKeyError) Is(target error) bool {
+	return target == nfour.ErrNotFound
+}
+
+// RouteStats 单个rpc方法的调用统计
+type RouteStats struct {
+	Key any
+	// Calls 业务处理函数的调用次数，不包括命中响应缓存的请求
+	Calls int64
+	// Errors 业务处理函数返回错误的次数
+	Errors int64
+	// CacheHits 命中响应缓存的次数，没有设置 WithCache 时为0
+	CacheHits int64
+	// CacheMisses 没有命中响应缓存的次数
+	CacheMisses int64
+	// Coalesced 与其他相同请求合并、共享响应的请求数，没有设置 WithCoalescing 时为0
+	Coalesced int64
+}
+
+// RouterStats SrvRouter 的运行状态
+type RouterStats struct {
+	// StartTime SrvRouter 的创建时间
+	StartTime time.Time
+	// InFlight 正在执行的请求数
+	InFlight int64
+	// NotFound 请求未注册方法的次数
+	NotFound int64
+	// Routes 每个方法的统计，按照方法名称排序
+	Routes []RouteStats
+}
 
 // SrvCodec rpc服务端编解码抽象
 type SrvCodec[REQ any, RES any] interface {
@@ -27,6 +76,9 @@ type SrvCodec[REQ any, RES any] interface {
 // 与 nfour.WorkingFunc 不同的是 HandleBiz 处理的是业务对象，nfour.WorkingFunc 处理的是二进制，
 type HandleBiz[REQ any, RES any] func(req *REQ) (*RES, error)
 
+// HandleBizContext 与 HandleBiz 相同，但可以通过 ctx 获取 WithTimeout 设置的截止时间，超时后 ctx 被取消，业务处理函数可以据此尽早返回
+type HandleBizContext[REQ any, RES any] func(ctx context.Context, req *REQ) (*RES, error)
+
 // HandleErrorFunc 转换err为需要返回的业务响应对象
 type HandleErrorFunc[RES any] func(err error, interfaceName any) *RES
 
@@ -43,58 +95,221 @@ func NewRpcWorking[REQ any, RES any](codec SrvCodec[REQ, RES], kExtractor func(r
 		keyExtractor: kExtractor,
 		errorToRes:   errToRes,
 	}
+	router.startTime = time.Now()
 	return func(task *nfour.Task) ([]byte, error) {
-		payload := task.PayLoad
-		return workingCore(router, payload)
+		return workingCore(router, task)
 	}, router
 }
 
-func workingCore[REQ any, RES any](router *SrvRouter[REQ, RES], payload []byte) ([]byte, error) {
-	req, err := router.codec.Decode(payload)
+// NewNegotiatedRpcWorking 与 NewRpcWorking 类似，但同一个 SrvRouter 可以服务使用不同编解码的客户端。
+// 请求数据的首字节表示内容类型，SrvRouter 使用 codecs 中对应的编解码解码请求并编码响应，首字节的含义及是否需要去除由编解码自己处理，
+// 没有对应的编解码时返回 nfour.StatusUnsupportedMedia 状态
+func NewNegotiatedRpcWorking[REQ any, RES any](codecs map[byte]SrvCodec[REQ, RES], kExtractor func(req *REQ) any, errToRes HandleErrorFunc[RES]) (nfour.WorkingFunc, *SrvRouter[REQ, RES]) {
+	router := &SrvRouter[REQ, RES]{
+		codecs:       codecs,
+		keyExtractor: kExtractor,
+		errorToRes:   errToRes,
+		startTime:    time.Now(),
+	}
+	return func(task *nfour.Task) ([]byte, error) {
+		return workingCore(router, task)
+	}, router
+}
+
+// workingCore 无法解码的请求、缺少或者未注册的方法名称属于框架级错误，直接返回携带状态码的错误，由通信层转换成帧状态;
+// 业务处理函数返回的错误仍然由 HandleErrorFunc 转换成业务响应
+func workingCore[REQ any, RES any](router *SrvRouter[REQ, RES], task *nfour.Task) ([]byte, error) {
+	payload := task.PayLoad
+	codec, err := router.codecOf(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := codec.Decode(payload)
 	if err != nil {
 		nfour.NFourLogger.InfoLn(err)
-		response, _ := router.codec.Encode(router.errorToRes(err, nil))
-		return response, nil
+		return nil, nfour.NewStatusError(nfour.StatusBadRequest, err.Error())
 	}
-	return router.run(req), nil
+	return router.run(req, codec, task)
 }
 
 // SrvRouter 服务端的方法路由器，它包含了编解码工具，方法注册表，方法名称提取工具等。
 // 服务端需要把方法名称及其对应的方法处理函数注册到 SrvRouter , 当请求进入时，能够使用方法提取工具从请求中提取到方法名称，并正确的找到方法处理函数，然后执行
 type SrvRouter[REQ any, RES any] struct {
 	codec        SrvCodec[REQ, RES]
+	codecs       map[byte]SrvCodec[REQ, RES]
 	regTable     sync.Map
 	keyExtractor func(req *REQ) any
 	errorToRes   HandleErrorFunc[RES]
+	startTime    time.Time
+	inFlight     atomic.Int64
+	notFound     atomic.Int64
+
+	priorityLimits [priorityCount]atomic.Pointer[priorityLimit]
+	reserve        atomic.Pointer[priorityReserve]
 }
 
-// Register 注册方法名称及方法处理函数
+// Register 注册方法名称及方法处理函数，opts 可以设置方法的并发上限、超时时间和优先级
 // 如果相同的方法名称注册多个函数，最后一个会覆盖前面的，并输出日志
-func (r *SrvRouter[REQ, RES]) Register(key any, fn HandleBiz[REQ, RES]) {
-	if _, loaded := r.regTable.LoadOrStore(key, fn); loaded {
-		nfour.NFourLogger.Info("%v exists\n", key)
+func (r *SrvRouter[REQ, RES]) Register(key any, fn HandleBiz[REQ, RES], opts ...RouteOption) {
+	r.RegisterContext(key, func(ctx context.Context, req *REQ) (*RES, error) {
+		return fn(req)
+	}, opts...)
+}
+
+// RegisterContext 与 Register 相同，但业务处理函数可以通过 ctx 获取方法的截止时间
+func (r *SrvRouter[REQ, RES]) RegisterContext(key any, fn HandleBizContext[REQ, RES], opts ...RouteOption) {
+	if _, loaded := r.regTable.Load(key); loaded {
+		nfour.NFourLogger.Info("%v exists, override\n", key)
+	}
+	r.regTable.Store(key, newRoute(fn, opts))
+}
+
+// Unregister 删除方法，返回方法是否存在
+func (r *SrvRouter[REQ, RES]) Unregister(key any) bool {
+	_, loaded := r.regTable.LoadAndDelete(key)
+	return loaded
+}
+
+// Keys 已注册的方法名称，按照名称排序
+func (r *SrvRouter[REQ, RES]) Keys() []any {
+	var keys []any
+	r.regTable.Range(func(key, value any) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sortKeys(keys)
+	return keys
+}
+
+// Stats SrvRouter 的运行状态及每个方法的调用统计
+func (r *SrvRouter[REQ, RES]) Stats() *RouterStats {
+	stats := &RouterStats{
+		StartTime: r.startTime,
+		InFlight:  r.inFlight.Load(),
+		NotFound:  r.notFound.Load(),
+	}
+	r.regTable.Range(func(key, value any) bool {
+		rt := value.(*route[REQ, RES])
+		rs := RouteStats{
+			Key:    key,
+			Calls:  rt.calls.Load(),
+			Errors: rt.errors.Load(),
+		}
+		if rt.opts.cache != nil {
+			rs.CacheHits = rt.opts.cache.hits.Load()
+			rs.CacheMisses = rt.opts.cache.misses.Load()
+		}
+		if rt.opts.coalescer != nil {
+			rs.Coalesced = rt.opts.coalescer.shared.Load()
+		}
+		stats.Routes = append(stats.Routes, rs)
+		return true
+	})
+	sort.Slice(stats.Routes, func(i, j int) bool {
+		return fmt.Sprint(stats.Routes[i].Key) < fmt.Sprint(stats.Routes[j].Key)
+	})
+	return stats
+}
+
+func sortKeys(keys []any) {
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+}
+
+// codecOf 根据请求的首字节选择编解码，没有配置多种编解码时使用唯一的编解码
+func (r *SrvRouter[REQ, RES]) codecOf(payload []byte) (SrvCodec[REQ, RES], error) {
+	if r.codecs == nil {
+		return r.codec, nil
+	}
+	if len(payload) == 0 {
+		return nil, nfour.NewStatusError(nfour.StatusBadRequest, "empty payload")
+	}
+	codec, ok := r.codecs[payload[0]]
+	if !ok {
+		return nil, nfour.NewStatusError(nfour.StatusUnsupportedMedia, fmt.Sprintf("content type 0x%02x", payload[0]))
 	}
+	return codec, nil
 }
 
-func (r *SrvRouter[REQ, RES]) run(req *REQ) []byte {
+func (r *SrvRouter[REQ, RES]) run(req *REQ, codec SrvCodec[REQ, RES], task *nfour.Task) ([]byte, error) {
+	payload := task.PayLoad
+	rt, key, err := r.lookup(req)
+	if err != nil {
+		return nil, err
+	}
+	if rt.opts.cache != nil {
+		if buf, ok := rt.opts.cache.get(payload); ok {
+			return buf, nil
+		}
+	}
+	if rt.opts.coalescer == nil {
+		return r.execute(rt, key, req, codec, task)
+	}
+	return rt.opts.coalescer.do(payload, func() ([]byte, error) {
+		return r.execute(rt, key, req, codec, task)
+	})
+}
+
+// execute 执行业务处理函数并编码响应，业务处理函数没有返回错误时把响应写入缓存
+func (r *SrvRouter[REQ, RES]) execute(rt *route[REQ, RES], key any, req *REQ, codec SrvCodec[REQ, RES], task *nfour.Task) ([]byte, error) {
+	res, bizErr, err := r.dispatch(rt, key, req, task)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := codec.Encode(res)
+	if err == nil && bizErr == nil && rt.opts.cache != nil {
+		rt.opts.cache.put(task.PayLoad, buf)
+	}
+	return buf, err
+}
+
+// Handle 执行已经解码的请求，可以用于在一个请求内分发多个请求，比如批量请求，响应缓存和请求合并只对 nfour.WorkingFunc 收到的请求生效。
+// 缺少方法名称、方法未注册、过载等框架级错误直接返回，业务处理函数的错误由 HandleErrorFunc 转换成业务响应
+func (r *SrvRouter[REQ, RES]) Handle(req *REQ) (*RES, error) {
+	return r.HandleTask(req, nil)
+}
+
+// HandleTask 与 Handle 相同，task 是请求占用的服务端并发，业务处理超时(WithTimeout)时由 task.Hold 接管，直到业务处理函数返回才释放
+func (r *SrvRouter[REQ, RES]) HandleTask(req *REQ, task *nfour.Task) (*RES, error) {
+	res, _, err := r.Dispatch(req, task)
+	return res, err
+}
+
+// Dispatch 与 HandleTask 相同，bizErr 是业务处理函数返回的错误，它已经被 HandleErrorFunc 转换成 res，
+// 用于需要区分业务错误和正常响应的场景，比如http网关根据 bizErr 设置http状态码
+func (r *SrvRouter[REQ, RES]) Dispatch(req *REQ, task *nfour.Task) (res *RES, bizErr error, err error) {
+	rt, key, err := r.lookup(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.dispatch(rt, key, req, task)
+}
+
+func (r *SrvRouter[REQ, RES]) lookup(req *REQ) (*route[REQ, RES], any, error) {
 	key := r.keyExtractor(req)
 	if key == nil {
-		return r.handleErr(badReqErr, nil)
+		return nil, nil, ErrMissingKey
 	}
 	v, ok := r.regTable.Load(key)
 	if !ok {
-		return r.handleErr(badReqErr, key)
-	}
-	fn := v.(HandleBiz[REQ, RES])
-	res, err := fn(req)
-	if err != nil {
-		return r.handleErr(err, key)
+		r.notFound.Add(1)
+		return nil, key, &UnknownKeyError{Key: key}
 	}
-	buff, _ := r.codec.Encode(res)
-	return buff
+	return v.(*route[REQ, RES]), key, nil
 }
 
-func (r *SrvRouter[REQ, RES]) handleErr(err error, interfaceName any) []byte {
-	buf, _ := r.codec.Encode(r.errorToRes(err, interfaceName))
-	return buf
+// dispatch 获取并发许可后执行业务处理函数，bizErr 是业务处理函数返回的错误，已经被转换成 res。task 为nil表示请求不是由通信层直接提交的
+func (r *SrvRouter[REQ, RES]) dispatch(rt *route[REQ, RES], key any, req *REQ, task *nfour.Task) (res *RES, bizErr error, err error) {
+	release, err := r.acquire(rt)
+	if err != nil {
+		return nil, nil, err
+	}
+	rt.calls.Add(1)
+	res, bizErr = r.call(rt, req, release, task)
+	if bizErr != nil {
+		rt.errors.Add(1)
+		return r.errorToRes(bizErr, key), bizErr, nil
+	}
+	return res, nil, nil
 }
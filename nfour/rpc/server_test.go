@@ -0,0 +1,133 @@
+package rpc
+
+import (
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newStringRouter() (nfour.WorkingFunc, *SrvRouter[string, string]) {
+	return NewRpcWorking[string, string](bytesCodec{}, func(req *string) any {
+		return *req
+	}, func(err error, interfaceName any) *string {
+		s := "err:" + err.Error()
+		return &s
+	})
+}
+
+func blockingHandler(block chan struct{}) HandleBiz[string, string] {
+	return func(req *string) (*string, error) {
+		<-block
+		return req, nil
+	}
+}
+
+func call(working nfour.WorkingFunc, key string) (string, error) {
+	res, err := working(&nfour.Task{PayLoad: []byte(key)})
+	return string(res), err
+}
+
+func TestRouteTimeout(t *testing.T) {
+	working, router := newStringRouter()
+	block := make(chan struct{})
+	defer close(block)
+	router.Register("slow", blockingHandler(block), WithTimeout(time.Millisecond*20))
+
+	res, err := call(working, "slow")
+	if err != nil || !strings.HasPrefix(res, "err:rpc handler timeout") {
+		t.Fatalf("expect timeout response, got %s %v", res, err)
+	}
+	if nfour.StatusOf(ErrHandlerTimeout) != nfour.StatusDeadlineExceeded {
+		t.Fatal("handler timeout should map to deadline exceeded")
+	}
+}
+
+func TestRouteTimeoutHoldsServerSlot(t *testing.T) {
+	working, router := newStringRouter()
+	block := make(chan struct{})
+	router.Register("slow", blockingHandler(block), WithTimeout(time.Millisecond*20))
+
+	var released atomic.Int32
+	task := nfour.NewTask([]byte("slow"), func() {
+		released.Add(1)
+	})
+	res, err := working(task)
+	if err != nil || !strings.HasPrefix(string(res), "err:rpc handler timeout") {
+		t.Fatalf("expect timeout response, got %s %v", res, err)
+	}
+	// 通信层写出响应后释放并发，但业务处理函数仍在执行
+	task.Done()
+	if released.Load() != 0 {
+		t.Fatal("server slot released while handler is still running")
+	}
+	close(block)
+	waitInFlight(t, router, 0)
+	deadline := time.Now().Add(time.Second)
+	for released.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("server slot released %d times", released.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPriorityReserve(t *testing.T) {
+	working, router := newStringRouter()
+	block := make(chan struct{})
+	router.Register("report", blockingHandler(block))
+	router.Register("lookup", blockingHandler(block), WithPriority(PriorityHigh))
+	router.SetPriorityReserve(2, 1, 0)
+
+	go call(working, "report")
+	waitInFlight(t, router, 1)
+	if _, err := call(working, "report"); !errors.Is(err, nfour.ErrRejectedConcurrent) {
+		t.Fatalf("normal priority should not use reserved capacity, got %v", err)
+	}
+	go call(working, "lookup")
+	waitInFlight(t, router, 2)
+	if _, err := call(working, "lookup"); !errors.Is(err, nfour.ErrRejectedConcurrent) {
+		t.Fatalf("expect overload when capacity is used up, got %v", err)
+	}
+	close(block)
+	waitInFlight(t, router, 0)
+}
+
+func TestRouteConcurrencyAndPriority(t *testing.T) {
+	working, router := newStringRouter()
+	block := make(chan struct{})
+	router.Register("report", blockingHandler(block), WithMaxConcurrency(1, 0))
+	router.Register("export", blockingHandler(block), WithPriority(PriorityLow))
+	router.Register("lookup", func(req *string) (*string, error) {
+		return req, nil
+	})
+	router.SetPriorityLimit(PriorityLow, 1, 0)
+
+	go call(working, "report")
+	waitInFlight(t, router, 1)
+	if _, err := call(working, "report"); !errors.Is(err, nfour.ExceedConcurrentError) {
+		t.Fatalf("expect per key overload, got %v", err)
+	}
+	go call(working, "export")
+	waitInFlight(t, router, 2)
+	if _, err := call(working, "export"); !errors.Is(err, nfour.ExceedConcurrentError) {
+		t.Fatalf("expect priority overload, got %v", err)
+	}
+	if res, err := call(working, "lookup"); err != nil || res != "lookup" {
+		t.Fatalf("lookup should not be blocked, got %s %v", res, err)
+	}
+	close(block)
+	waitInFlight(t, router, 0)
+}
+
+func waitInFlight(t *testing.T, router *SrvRouter[string, string], n int64) {
+	deadline := time.Now().Add(time.Second)
+	for router.Stats().InFlight != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("in flight never reached %d", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,45 @@
+// rpc abstraction basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package rpc
+
+import (
+	"github.com/rolandhe/saber/nfour"
+)
+
+// Transport rpc客户端底层的二进制传输抽象，负责发送二进制请求并返回二进制响应。
+// duplex.Trans、simplex.Client、loopback.Trans 以及 discovery.TransPool 都实现了该接口，
+// 因此同一个 Client 可以运行在不同的传输方式上，也可以使用内存实现进行单元测试
+type Transport interface {
+	// SendPayload 发送二进制请求，返回二进制响应
+	SendPayload(req []byte, reqTimeout *nfour.ReqTimeout) ([]byte, error)
+	// Shutdown 关闭传输，释放连接等资源
+	Shutdown(source string)
+}
+
+// CancelableTransport 支持取消请求的 Transport，对冲请求需要取消落后的请求，没有实现该接口的 Transport 上落后的请求只是被丢弃
+type CancelableTransport interface {
+	Transport
+	// SendPayloadCancel 与 SendPayload 相同，但可以在收到响应前通过关闭 cancel 来取消请求
+	SendPayloadCancel(req []byte, reqTimeout *nfour.ReqTimeout, cancel <-chan struct{}) ([]byte, error)
+}
+
+// AvailabilityAware 可以报告自身是否可用的 Transport，Client 选择 Transport 时会跳过不可用的，没有实现该接口的 Transport 总是被认为可用
+type AvailabilityAware interface {
+	// IsAvailable 是否可以接收新的请求，比如连接已经关闭、熔断器打开时返回false
+	IsAvailable() bool
+}
+
+func isAvailable(t Transport) bool {
+	if aware, ok := t.(AvailabilityAware); ok {
+		return aware.IsAvailable()
+	}
+	return true
+}
+
+func sendPayloadCancel(t Transport, req []byte, reqTimeout *nfour.ReqTimeout, cancel <-chan struct{}) ([]byte, error) {
+	if ct, ok := t.(CancelableTransport); ok {
+		return ct.SendPayloadCancel(req, reqTimeout, cancel)
+	}
+	return t.SendPayload(req, reqTimeout)
+}
@@ -0,0 +1,267 @@
+// rpc abstraction basing nfour
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package simplex
+
+import (
+	"errors"
+	"github.com/rolandhe/saber/gocc"
+	"github.com/rolandhe/saber/nfour"
+	"github.com/rolandhe/saber/utils/bytutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientConf 单路模式客户端的配置
+type ClientConf struct {
+	// ReadTimeout 网络读取超时时间
+	ReadTimeout time.Duration
+	// WriteTimeout 网络写出超时
+	WriteTimeout time.Duration
+	// DialTimeout 建立连接的超时时间
+	DialTimeout time.Duration
+	// MaxIdle 连接池中最多保留的空闲连接数
+	MaxIdle uint
+	// IdleTimeout 空闲连接超过该时间没有被使用，会被关闭，避免使用已经被服务端关闭的连接
+	IdleTimeout time.Duration
+	// Dialer 建立连接的函数，nil表示使用 net.DialTimeout 建立tcp连接，一般用于测试
+	Dialer     func(addr string, timeout time.Duration) (net.Conn, error)
+	concurrent gocc.Semaphore
+}
+
+// NewClientConf 构建单路模式客户端的配置
+//
+// rwTimeout 读写超时，这种情况下，读写超时是相同的
+//
+// maxConns 最大连接数，单路模式下每个连接同时只能处理一个请求，所以它也是客户端的最大并发数
+func NewClientConf(rwTimeout time.Duration, maxConns uint) *ClientConf {
+	return &ClientConf{
+		ReadTimeout:  rwTimeout,
+		WriteTimeout: rwTimeout,
+		DialTimeout:  time.Second * 3,
+		MaxIdle:      maxConns,
+		IdleTimeout:  time.Minute * 5,
+		concurrent:   gocc.NewDefaultSemaphore(maxConns),
+	}
+}
+
+// NewClient 构建单路模式的客户端，构建时会建立一个连接来验证服务端地址是否可用，该连接会放入连接池
+//
+// name 表示该 Client 的名称，该名称会被输出到日志中，方便发现问题
+func NewClient(addr string, conf *ClientConf, name string) (*Client, error) {
+	c := &Client{
+		addr: addr,
+		conf: conf,
+		idle: make(chan *idleConn, conf.MaxIdle),
+		name: name,
+	}
+	conn, err := c.dial()
+	if err != nil {
+		nfour.NFourLogger.InfoLn(err)
+		return nil, err
+	}
+	c.putIdle(conn)
+	return c, nil
+}
+
+// Client 单路模式的客户端，内部维护一个连接池，每个请求从连接池中获取一个连接，同步的写出请求、读取响应，完成后归还连接。
+// 请求格式与服务端相同，即 4个字节的长度 + payload。
+//
+// 单路模式的服务端没有帧状态码，服务端的错误由 nfour.SrvConf.ErrHandle 转换成响应数据返回，客户端无法区分，需要业务层自己解析
+type Client struct {
+	addr   string
+	conf   *ClientConf
+	idle   chan *idleConn
+	status int32
+	name   string
+	// idleLock 保证 Shutdown 清空连接池之后不会再有连接被放入
+	idleLock sync.Mutex
+}
+
+type idleConn struct {
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+// Shutdown 关闭客户端，空闲连接会被立即关闭，正在使用的连接在请求完成后关闭
+// source 发起Shutdown的场景，用于日志记录
+func (c *Client) Shutdown(source string) {
+	if !atomic.CompareAndSwapInt32(&c.status, 0, 1) {
+		return
+	}
+	nfour.NFourLogger.Info("%s trigger %s shutdown\n", source, c.name)
+	c.idleLock.Lock()
+	defer c.idleLock.Unlock()
+	for {
+		select {
+		case ic := <-c.idle:
+			ic.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// IsShutdown Client 是否已经被关闭，如果已经被关闭，将不能接收新的发送请求
+func (c *Client) IsShutdown() bool {
+	return atomic.LoadInt32(&c.status) == 1
+}
+
+// IsAvailable Client 是否可以接收新的请求
+func (c *Client) IsAvailable() bool {
+	return !c.IsShutdown()
+}
+
+// SendPayload 发送二进制请求并同步等待响应
+//
+// reqTimeout 本次请求的超时时间, 读取超时返回 nfour.ErrTaskTimeout，到达最大连接数后等待超时返回 nfour.ExceedConcurrentError
+func (c *Client) SendPayload(req []byte, reqTimeout *nfour.ReqTimeout) ([]byte, error) {
+	return c.SendPayloadCancel(req, reqTimeout, nil)
+}
+
+// SendPayloadCancel 与 SendPayload 相同，但可以在收到响应前通过关闭 cancel 来取消请求，取消后返回 nfour.ErrTaskCancelled，
+// 被取消请求使用的连接会被关闭
+func (c *Client) SendPayloadCancel(req []byte, reqTimeout *nfour.ReqTimeout, cancel <-chan struct{}) ([]byte, error) {
+	if c.IsShutdown() {
+		return nil, nfour.ErrTransShutdown
+	}
+	if reqTimeout == nil {
+		reqTimeout = &nfour.ReqTimeout{}
+	}
+	if !c.conf.concurrent.AcquireTimeout(reqTimeout.WaitConcurrent) {
+		return nil, nfour.ExceedConcurrentError
+	}
+	defer c.conf.concurrent.Release()
+
+	readTimeout := reqTimeout.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = c.conf.ReadTimeout
+	}
+	writeTimeout := reqTimeout.WriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = c.conf.WriteTimeout
+	}
+
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cancelled atomic.Bool
+	if cancel != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-cancel:
+				cancelled.Store(true)
+				conn.SetDeadline(time.Now())
+			case <-done:
+			}
+		}()
+	}
+
+	res, err := c.roundTrip(conn, req, writeTimeout, readTimeout)
+	if err != nil {
+		conn.Close()
+		if cancelled.Load() {
+			return nil, nfour.ErrTaskCancelled
+		}
+		return nil, err
+	}
+	if cancelled.Load() {
+		conn.Close()
+		return res, nil
+	}
+	c.putIdle(conn)
+	return res, nil
+}
+
+func (c *Client) roundTrip(conn net.Conn, req []byte, writeTimeout time.Duration, readTimeout time.Duration) ([]byte, error) {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := writeFrame(conn, req); err != nil {
+		nfour.NFourLogger.Info("%s write err:%v\n", c.name, err)
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	header := make([]byte, nfour.PayLoadLenBufLength)
+	if err := nfour.InternalReadPayload(conn, header, nfour.PayLoadLenBufLength, false); err != nil {
+		return nil, c.convertReadErr(err)
+	}
+	l, err := nfour.InternalPayloadLength(header)
+	if err != nil {
+		nfour.NFourLogger.Info("%s read err:%v\n", c.name, err)
+		return nil, err
+	}
+	body := make([]byte, l)
+	if err := nfour.InternalReadPayload(conn, body, l, false); err != nil {
+		return nil, c.convertReadErr(err)
+	}
+	return body, nil
+}
+
+func (c *Client) convertReadErr(err error) error {
+	nfour.NFourLogger.Info("%s read err:%v\n", c.name, err)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nfour.ErrTaskTimeout
+	}
+	return err
+}
+
+// getConn 优先使用没有过期的空闲连接，没有空闲连接时建立新连接
+func (c *Client) getConn() (net.Conn, error) {
+	for {
+		select {
+		case ic := <-c.idle:
+			if time.Since(ic.lastUsed) < c.conf.IdleTimeout {
+				return ic.conn, nil
+			}
+			ic.conn.Close()
+		default:
+			return c.dial()
+		}
+	}
+}
+
+func (c *Client) putIdle(conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+	c.idleLock.Lock()
+	defer c.idleLock.Unlock()
+	if c.IsShutdown() {
+		conn.Close()
+		return
+	}
+	select {
+	case c.idle <- &idleConn{conn, time.Now()}:
+	default:
+		conn.Close()
+	}
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	if c.conf.Dialer != nil {
+		return c.conf.Dialer(c.addr, c.conf.DialTimeout)
+	}
+	return net.DialTimeout("tcp", c.addr, c.conf.DialTimeout)
+}
+
+// writeFrame 写出 4个字节的长度 + payload，处理部分写出的情况，直到全部写出或者出错
+func writeFrame(conn net.Conn, res []byte) error {
+	plen := len(res)
+	payload := make([]byte, plen+nfour.PayLoadLenBufLength)
+	copy(payload, bytutil.Int32ToBytes(int32(plen)))
+	copy(payload[nfour.PayLoadLenBufLength:], res)
+
+	for len(payload) > 0 {
+		n, err := conn.Write(payload)
+		if err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package simplex
+
+import (
+	"errors"
+	"github.com/rolandhe/saber/nfour"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type trackedConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *trackedConn) Close() error {
+	c.closed.Store(true)
+	return c.Conn.Close()
+}
+
+// testDialer 记录建立的连接
+type testDialer struct {
+	lock  sync.Mutex
+	conns []*trackedConn
+}
+
+func (d *testDialer) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: conn}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.conns = append(d.conns, tc)
+	return tc, nil
+}
+
+func (d *testDialer) dialed() []*trackedConn {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]*trackedConn(nil), d.conns...)
+}
+
+func newTestClient(t *testing.T) (*Client, *testDialer) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	working := func(task *nfour.Task) ([]byte, error) {
+		if string(task.PayLoad) == "slow" {
+			time.Sleep(time.Millisecond * 500)
+		}
+		return task.PayLoad, nil
+	}
+	go Serve(ln, nfour.NewSrvConf(working, func(err error) []byte { return []byte(err.Error()) }, 10))
+
+	dialer := &testDialer{}
+	conf := NewClientConf(time.Second*2, 4)
+	conf.Dialer = dialer.dial
+	client, err := NewClient(ln.Addr().String(), conf, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Shutdown("test") })
+	return client, dialer
+}
+
+func TestClientReusesIdleConn(t *testing.T) {
+	client, dialer := newTestClient(t)
+	for i := 0; i < 5; i++ {
+		res, err := client.SendPayload([]byte("ping"), nil)
+		if err != nil || string(res) != "ping" {
+			t.Fatalf("unexpected result %s %v", res, err)
+		}
+	}
+	if n := len(dialer.dialed()); n != 1 {
+		t.Fatalf("expect 1 connection, got %d", n)
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	client, dialer := newTestClient(t)
+	cancel := make(chan struct{})
+	time.AfterFunc(time.Millisecond*20, func() {
+		close(cancel)
+	})
+	start := time.Now()
+	if _, err := client.SendPayloadCancel([]byte("slow"), nil, cancel); !errors.Is(err, nfour.ErrTaskCancelled) {
+		t.Fatalf("expect ErrTaskCancelled, got %v", err)
+	}
+	if cost := time.Since(start); cost >= time.Millisecond*500 {
+		t.Fatalf("cancel did not interrupt the request: %v", cost)
+	}
+	conns := dialer.dialed()
+	if !conns[0].closed.Load() {
+		t.Fatal("connection of cancelled request should be closed")
+	}
+	if res, err := client.SendPayload([]byte("ping"), nil); err != nil || string(res) != "ping" {
+		t.Fatalf("unexpected result after cancel %s %v", res, err)
+	}
+	if n := len(dialer.dialed()); n != 2 {
+		t.Fatalf("expect a new connection after cancel, got %d", n)
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	client, dialer := newTestClient(t)
+	client.Shutdown("test")
+	conns := dialer.dialed()
+	if !conns[0].closed.Load() {
+		t.Fatal("idle connection should be closed")
+	}
+	if _, err := client.SendPayload([]byte("ping"), nil); !errors.Is(err, nfour.ErrTransShutdown) {
+		t.Fatalf("expect ErrTransShutdown, got %v", err)
+	}
+
+	// 请求结束时客户端已经关闭，连接不能再放入连接池
+	conn, err := dialer.dial(client.addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.putIdle(conn)
+	if !dialer.dialed()[1].closed.Load() || len(client.idle) != 0 {
+		t.Fatal("connection returned after shutdown should be closed")
+	}
+}
@@ -1,13 +1,12 @@
 // rpc abstraction basing nfour
 // Copyright 2023 The saber Authors. All rights reserved.
 
-// Package simplex 单路模式的服务端实现，类似于http1.1， 大量客户端但每个客户请求较少的场景。每个连接上request/response是同步模式，每个请求必须得到响应以后才能发送另一个请求。
-// 用于兼容一些老的场景，因此该模式下没有提供客户端组件。
+// Package simplex 单路模式的服务端和客户端实现，类似于http1.1， 大量客户端但每个客户请求较少的场景。每个连接上request/response是同步模式，每个请求必须得到响应以后才能发送另一个请求。
+// 主要用于兼容一些老的场景，客户端 Client 内部维护连接池来支持并发请求。
 package simplex
 
 import (
 	"github.com/rolandhe/saber/nfour"
-	"github.com/rolandhe/saber/utils/bytutil"
 	"net"
 	"strconv"
 	"time"
@@ -25,6 +24,12 @@ func Startup(port int, conf *nfour.SrvConf) {
 		return
 	}
 	nfour.NFourLogger.Info("listen tcp port %d,and next to accept\n", port)
+	Serve(ln, conf)
+}
+
+// Serve 使用已经创建的 net.Listener 提供单路服务，直到 Accept 失败(比如 ln 被关闭)才返回，
+// 可以用于包装过的listener，比如测试中注入网络故障
+func Serve(ln net.Listener, conf *nfour.SrvConf) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -46,24 +51,37 @@ func handleConnection(conn net.Conn, conf *nfour.SrvConf) {
 			releaseConn(conn)
 			break
 		}
-		l, _ := bytutil.ToInt32(header[:nfour.PayLoadLenBufLength])
-		bodyBuff := make([]byte, l, l)
+		l, err := nfour.InternalPayloadLength(header)
+		if err != nil {
+			nfour.NFourLogger.InfoLn(err)
+			releaseConn(conn)
+			break
+		}
+		bodyBuff := make([]byte, l)
 		conn.SetReadDeadline(time.Now().Add(conf.ReadTimeout))
-		err = nfour.InternalReadPayload(conn, bodyBuff, int(l), false)
+		err = nfour.InternalReadPayload(conn, bodyBuff, l, false)
 		if err != nil {
 			releaseConn(conn)
 			break
 		}
 
+		if !conf.AdmitRate() {
+			if !writeCore(conf.ErrHandle(nfour.ErrRejectedRateLimit), conn, conf.WriteTimeout) {
+				releaseConn(conn)
+				break
+			}
+			continue
+		}
 		if !conf.GetConcurrent().AcquireTimeout(conf.SemaWaitTime) {
-			if !writeCore(conf.ErrHandle(nfour.ExceedConcurrentError), conn, conf.WriteTimeout) {
+			if !writeCore(conf.ErrHandle(nfour.ErrRejectedConcurrent), conn, conf.WriteTimeout) {
 				releaseConn(conn)
 				break
 			}
 			continue
 		}
-		ok := doBiz(bodyBuff, conn, conf)
-		conf.GetConcurrent().Release()
+		task := nfour.NewTask(bodyBuff, conf.GetConcurrent().Release)
+		ok := doBiz(task, conn, conf)
+		task.Done()
 		if !ok {
 			releaseConn(conn)
 			break
@@ -71,8 +89,7 @@ func handleConnection(conn net.Conn, conf *nfour.SrvConf) {
 	}
 }
 
-func doBiz(bodyBuff []byte, conn net.Conn, conf *nfour.SrvConf) bool {
-	task := &nfour.Task{PayLoad: bodyBuff}
+func doBiz(task *nfour.Task, conn net.Conn, conf *nfour.SrvConf) bool {
 	resBody, err := conf.Working(task)
 
 	if err != nil {
@@ -89,18 +106,11 @@ func releaseConn(conn net.Conn) {
 
 func writeCore(res []byte, conn net.Conn, timeout time.Duration) bool {
 	conn.SetWriteDeadline(time.Now().Add(timeout))
-
-	plen := len(res)
-	payload := make([]byte, plen+nfour.PayLoadLenBufLength)
-	copy(payload, bytutil.Int32ToBytes(int32(plen)))
-	copy(payload[nfour.PayLoadLenBufLength:], res)
-
-	n, err := conn.Write(payload)
-	if err != nil {
+	if err := writeFrame(conn, res); err != nil {
 		conn.Close()
 		nfour.NFourLogger.InfoLn(err)
 		return false
 	}
-	nfour.NFourLogger.Debug("write data:%d, expect:%d\n", n, plen+nfour.PayLoadLenBufLength)
+	nfour.NFourLogger.Debug("write data:%d\n", len(res)+nfour.PayLoadLenBufLength)
 	return true
 }
@@ -0,0 +1,179 @@
+// net framework basing tcp, tcp is 4th layer of osi net model
+//
+// Copyright 2023 The saber Authors. All rights reserved.
+
+package nfour
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+)
+
+// Status 帧级别的响应状态码，多路复用模式下每个响应帧的header中都会携带该状态码，客户端据此区分业务响应和服务端错误
+type Status uint8
+
+const (
+	// StatusOK 请求被正常处理，payload是业务响应
+	StatusOK Status = iota
+	// StatusOverloaded 服务端超出最大并发、超出QPS限制等过载情况，请求没有被执行，只由 RejectedError 产生
+	StatusOverloaded
+	// StatusBadRequest 请求数据不合法，无法被处理
+	StatusBadRequest
+	// StatusNotFound 请求的方法不存在
+	StatusNotFound
+	// StatusInternal 服务端内部错误
+	StatusInternal
+	// StatusDeadlineExceeded 服务端处理超时
+	StatusDeadlineExceeded
+	// StatusUnsupportedMedia 服务端不支持请求的内容类型(编解码)
+	StatusUnsupportedMedia
+)
+
+var (
+	// ErrBadRequest 客户端收到 StatusBadRequest 状态时对应的错误
+	ErrBadRequest = errors.New("bad request")
+	// ErrNotFound 客户端收到 StatusNotFound 状态时对应的错误
+	ErrNotFound = errors.New("not found")
+	// ErrInternal 客户端收到 StatusInternal 状态时对应的错误
+	ErrInternal = errors.New("internal error")
+	// ErrDeadlineExceeded 客户端收到 StatusDeadlineExceeded 状态时对应的错误
+	ErrDeadlineExceeded = errors.New("deadline exceeded")
+	// ErrUnsupportedMedia 客户端收到 StatusUnsupportedMedia 状态时对应的错误
+	ErrUnsupportedMedia = errors.New("unsupported media")
+)
+
+var statusNames = map[Status]string{
+	StatusOK:               "ok",
+	StatusOverloaded:       "overloaded",
+	StatusBadRequest:       "bad request",
+	StatusNotFound:         "not found",
+	StatusInternal:         "internal",
+	StatusDeadlineExceeded: "deadline exceeded",
+	StatusUnsupportedMedia: "unsupported media",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return "status(" + strconv.Itoa(int(s)) + ")"
+}
+
+// StatusError 携带帧状态码的错误, 服务端可以返回该错误来指定响应的状态码(StatusOverloaded 除外，见 StatusOf)，客户端收到非 StatusOK 的响应时也会返回该错误
+//
+// 可以使用 errors.Is 判断具体的错误类型，比如 errors.Is(err, nfour.ExceedConcurrentError) 可以识别服务端过载
+type StatusError struct {
+	Code    Status
+	Message string
+}
+
+// NewStatusError 构建 StatusError
+func NewStatusError(code Status, message string) *StatusError {
+	return &StatusError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return e.Code.String()
+	}
+	return e.Code.String() + ": " + e.Message
+}
+
+// Is 支持 errors.Is 与状态码对应的哨兵错误比较
+func (e *StatusError) Is(target error) bool {
+	if t, ok := target.(*StatusError); ok {
+		return t.Code == e.Code
+	}
+	return target == statusSentinel(e.Code)
+}
+
+// RejectedError 服务端的准入拒绝，比如超出最大并发、超出QPS限制，请求没有被执行，StatusOf 返回 StatusOverloaded。
+// 业务处理函数需要主动拒绝请求时可以返回该错误
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// Status 实现 StatusCarrier
+func (e *RejectedError) Status() Status {
+	return StatusOverloaded
+}
+
+var (
+	// ErrRejectedConcurrent 服务端超出最大并发拒绝请求，errors.Is(err, ExceedConcurrentError) 成立
+	ErrRejectedConcurrent error = &RejectedError{Err: ExceedConcurrentError}
+	// ErrRejectedRateLimit 服务端超出QPS限制拒绝请求，errors.Is(err, ExceedRateLimitError) 成立
+	ErrRejectedRateLimit error = &RejectedError{Err: ExceedRateLimitError}
+)
+
+// StatusCarrier 可以描述自身状态码的错误，服务端遇到实现了该接口的错误时使用其返回的状态码
+type StatusCarrier interface {
+	Status() Status
+}
+
+// StatusOf 获取err对应的帧状态码。
+// StatusOverloaded 表示请求没有被执行，客户端可以安全重试，因此只有 RejectedError 对应 StatusOverloaded；
+// 业务处理函数返回的其他过载错误，比如包装了下游的 ExceedConcurrentError 或者过载的 StatusError，请求已经被执行，对应 StatusInternal
+func StatusOf(err error) Status {
+	if err == nil {
+		return StatusOK
+	}
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		return StatusOverloaded
+	}
+	status := StatusInternal
+	var se *StatusError
+	var carrier StatusCarrier
+	switch {
+	case errors.As(err, &se):
+		status = se.Code
+	case errors.As(err, &carrier):
+		status = carrier.Status()
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		status = StatusDeadlineExceeded
+	}
+	if status == StatusOverloaded {
+		return StatusInternal
+	}
+	return status
+}
+
+// StatusMessageOf 获取err需要通过帧返回给客户端的错误信息，StatusError 只返回其 Message，避免客户端重复拼接状态描述
+func StatusMessageOf(err error) string {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Message
+	}
+	return err.Error()
+}
+
+func statusSentinel(code Status) error {
+	switch code {
+	case StatusOverloaded:
+		return ExceedConcurrentError
+	case StatusBadRequest:
+		return ErrBadRequest
+	case StatusNotFound:
+		return ErrNotFound
+	case StatusInternal:
+		return ErrInternal
+	case StatusDeadlineExceeded:
+		return ErrDeadlineExceeded
+	case StatusUnsupportedMedia:
+		return ErrUnsupportedMedia
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package nfour
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestStatusOfOverloaded(t *testing.T) {
+	cases := []struct {
+		err    error
+		status Status
+	}{
+		{ErrRejectedConcurrent, StatusOverloaded},
+		{ErrRejectedRateLimit, StatusOverloaded},
+		{fmt.Errorf("admission: %w", ErrRejectedConcurrent), StatusOverloaded},
+		// 业务处理函数返回的下游过载错误，请求已经被执行
+		{fmt.Errorf("call stock service: %w", ExceedConcurrentError), StatusInternal},
+		{fmt.Errorf("call stock service: %w", NewStatusError(StatusOverloaded, "busy")), StatusInternal},
+		{NewStatusError(StatusNotFound, "no method"), StatusNotFound},
+		{context.DeadlineExceeded, StatusDeadlineExceeded},
+	}
+	for _, c := range cases {
+		if got := StatusOf(c.err); got != c.status {
+			t.Errorf("StatusOf(%v) = %s, expect %s", c.err, got, c.status)
+		}
+	}
+	if !errors.Is(ErrRejectedConcurrent, ExceedConcurrentError) || !errors.Is(ErrRejectedRateLimit, ExceedRateLimitError) {
+		t.Fatal("rejected errors should wrap the exceed errors")
+	}
+}